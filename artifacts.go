@@ -0,0 +1,201 @@
+package qmkwrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// historyDir is the directory (relative to the output directory) where
+	// all built artifacts are stored.
+	historyDir = "history"
+)
+
+var (
+	// methods that are stubbed in tests
+	osMkdirAll = os.MkdirAll
+)
+
+// historyEntry is an artifact stored in the artifact history.
+type historyEntry struct {
+	// group is the artifact name without the extension (`<kb>_<km>`).
+	group string
+	// id is the timestamp and commit the artifact was built at.
+	id       string
+	ext      string
+	manifest *Manifest
+}
+
+// ID returns the ID used to refer to the entry in `q artifacts` commands. The
+// extension is included since a group can have both hex and bin artifacts.
+func (he *historyEntry) ID() string {
+	return fmt.Sprintf("%s/%s.%s", he.group, he.id, he.ext)
+}
+
+func (qw *qmkWrapper) historyFile(group, id, ext string) string {
+	return filepath.Join(qw.profile().OutputDir, historyDir, group, fmt.Sprintf("%s.%s", id, ext))
+}
+
+// archiveArtifact stores a copy of the artifact (and its manifest) in the
+// artifact history so it can be restored later.
+func (qw *qmkWrapper) archiveArtifact(bf string, data []byte, m *Manifest) error {
+	commit := m.Commit
+	if len(commit) > 6 {
+		commit = commit[:6]
+	}
+	id := fmt.Sprintf("%s-%s", m.Timestamp.Format("20060102-150405.000000000"), commit)
+	group := strings.TrimSuffix(bf, "."+m.Artifact)
+
+	if err := osMkdirAll(filepath.Join(qw.profile().OutputDir, historyDir, group), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+	// Never overwrite another build's history entry (e.g. if the clock is coarse).
+	f := qw.historyFile(group, id, m.Artifact)
+	for n := 2; ; n++ {
+		if _, err := osStat(f); os.IsNotExist(err) {
+			break
+		}
+		f = qw.historyFile(group, fmt.Sprintf("%s-%d", id, n), m.Artifact)
+	}
+	if err := osWriteFile(f, data, 0644); err != nil {
+		return fmt.Errorf("failed to write history file: %v", err)
+	}
+	return writeManifest(f, m)
+}
+
+// history returns all artifacts in the history, newest first within each group.
+func (qw *qmkWrapper) history() ([]*historyEntry, error) {
+	root := filepath.Join(qw.profile().OutputDir, historyDir)
+	groups, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read history directory: %v", err)
+	}
+
+	var entries []*historyEntry
+	for _, g := range groups {
+		if !g.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(root, g.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history directory: %v", err)
+		}
+
+		var groupEntries []*historyEntry
+		for _, f := range files {
+			if f.IsDir() || strings.HasSuffix(f.Name(), manifestSuffix) {
+				continue
+			}
+			ext := strings.TrimPrefix(filepath.Ext(f.Name()), ".")
+			he := &historyEntry{
+				group: g.Name(),
+				id:    strings.TrimSuffix(f.Name(), "."+ext),
+				ext:   ext,
+			}
+			// A missing manifest isn't fatal; the artifact can still be restored.
+			he.manifest, _ = readManifest(qw.historyFile(he.group, he.id, he.ext))
+			groupEntries = append(groupEntries, he)
+		}
+		sort.Slice(groupEntries, func(i, j int) bool { return groupEntries[i].id > groupEntries[j].id })
+		entries = append(entries, groupEntries...)
+	}
+	return entries, nil
+}
+
+func readManifest(artifact string) (*Manifest, error) {
+	b, err := osReadFile(artifact + manifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// isLatest returns whether the entry is the artifact currently in the output directory.
+func (qw *qmkWrapper) isLatest(he *historyEntry) bool {
+	if he.manifest == nil {
+		return false
+	}
+	m, err := readManifest(filepath.Join(qw.profile().OutputDir, fmt.Sprintf("%s.%s", he.group, he.ext)))
+	return err == nil && m.SHA256 == he.manifest.SHA256 && m.Timestamp.Equal(he.manifest.Timestamp)
+}
+
+func (qw *qmkWrapper) listArtifacts(o command.Output) error {
+	entries, err := qw.history()
+	if err != nil {
+		return o.Err(err)
+	}
+	for _, he := range entries {
+		var latest string
+		if qw.isLatest(he) {
+			latest = " (latest)"
+		}
+		o.Stdoutf("%s%s\n", he.ID(), latest)
+	}
+	return nil
+}
+
+// pruneArtifacts removes all but the newest `keep` artifacts for each keyboard/keymap.
+func (qw *qmkWrapper) pruneArtifacts(o command.Output, keep int) error {
+	if keep < 0 {
+		return o.Err(fmt.Errorf("keep must be non-negative; got %d", keep))
+	}
+	entries, err := qw.history()
+	if err != nil {
+		return o.Err(err)
+	}
+
+	counts := map[string]int{}
+	for _, he := range entries {
+		counts[he.group]++
+		if counts[he.group] <= keep {
+			continue
+		}
+		f := qw.historyFile(he.group, he.id, he.ext)
+		if err := os.Remove(f); err != nil {
+			return o.Annotatef(err, "failed to remove %s", he.ID())
+		}
+		if err := os.Remove(f + manifestSuffix); err != nil && !os.IsNotExist(err) {
+			return o.Annotatef(err, "failed to remove manifest for %s", he.ID())
+		}
+		o.Stdoutf("Removed %s\n", he.ID())
+	}
+	return nil
+}
+
+// restoreArtifact makes the artifact with the provided ID the latest artifact
+// in the output directory.
+func (qw *qmkWrapper) restoreArtifact(o command.Output, id string) error {
+	entries, err := qw.history()
+	if err != nil {
+		return o.Err(err)
+	}
+	for _, he := range entries {
+		if he.ID() != id {
+			continue
+		}
+		bf := fmt.Sprintf("%s.%s", he.group, he.ext)
+		if _, err := copyFile(qw.historyFile(he.group, he.id, he.ext), filepath.Join(qw.profile().OutputDir, bf)); err != nil {
+			return o.Annotatef(err, "failed to restore %s", id)
+		}
+		if he.manifest != nil {
+			if err := writeManifest(filepath.Join(qw.profile().OutputDir, bf), he.manifest); err != nil {
+				return o.Annotatef(err, "failed to restore manifest for %s", id)
+			}
+		}
+		o.Stdoutf("Restored %s to %s\n", id, bf)
+		return nil
+	}
+	return o.Err(fmt.Errorf("unknown artifact %q (see `q artifacts list`)", id))
+}
@@ -0,0 +1,191 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commandertest"
+	"github.com/leep-frog/command/commandtest"
+)
+
+func TestArtifacts(t *testing.T) {
+	// Artifacts that exist in the history before each test (oldest first).
+	historyIDs := []string{
+		"20010203-040506.000000000-abc123",
+		"20010204-040506.000000000-def456",
+		"20010205-040506.000000000-aaa111",
+	}
+
+	for _, test := range []struct {
+		name string
+		etc  *commandtest.ExecuteTestCase
+		// wantHistory is the set of history IDs that remain after the command.
+		wantHistory []string
+		// wantLatest is the content of the latest artifact after the command.
+		wantLatest string
+	}{
+		{
+			name: "lists artifacts",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "list"},
+				WantStdout: strings.Join([]string{
+					"kb_km/20010205-040506.000000000-aaa111.bin",
+					"kb_km/20010204-040506.000000000-def456.bin (latest)",
+					"kb_km/20010203-040506.000000000-abc123.bin",
+					"",
+				}, "\n"),
+			},
+			wantHistory: historyIDs,
+			wantLatest:  "20010204-040506.000000000-def456",
+		},
+		{
+			name: "prunes artifacts",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "prune", "--keep", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keepFlag.Name(): 1,
+				}},
+				WantStdout: strings.Join([]string{
+					"Removed kb_km/20010204-040506.000000000-def456.bin",
+					"Removed kb_km/20010203-040506.000000000-abc123.bin",
+					"",
+				}, "\n"),
+			},
+			wantHistory: historyIDs[2:],
+			wantLatest:  "20010204-040506.000000000-def456",
+		},
+		{
+			name: "prune fails on negative keep",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "prune", "-k", "-1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keepFlag.Name(): -1,
+				}},
+				WantStderr: "keep must be non-negative; got -1\n",
+				WantErr:    fmt.Errorf("keep must be non-negative; got -1"),
+			},
+			wantHistory: historyIDs,
+			wantLatest:  "20010204-040506.000000000-def456",
+		},
+		{
+			name: "restores artifact",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "restore", "kb_km/20010203-040506.000000000-abc123.bin"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					artifactIDArg.Name(): "kb_km/20010203-040506.000000000-abc123.bin",
+				}},
+				WantStdout: "Restored kb_km/20010203-040506.000000000-abc123.bin to kb_km.bin\n",
+			},
+			wantHistory: historyIDs,
+			wantLatest:  "20010203-040506.000000000-abc123",
+		},
+		{
+			name: "restore fails without extension",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "restore", "kb_km/20010203-040506.000000000-abc123"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					artifactIDArg.Name(): "kb_km/20010203-040506.000000000-abc123",
+				}},
+				WantStderr: "unknown artifact \"kb_km/20010203-040506.000000000-abc123\" (see `q artifacts list`)\n",
+				WantErr:    fmt.Errorf("unknown artifact \"kb_km/20010203-040506.000000000-abc123\" (see `q artifacts list`)"),
+			},
+			wantHistory: historyIDs,
+			wantLatest:  "20010204-040506.000000000-def456",
+		},
+		{
+			name: "restore fails for unknown artifact",
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"artifacts", "restore", "kb_km/unknown"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					artifactIDArg.Name(): "kb_km/unknown",
+				}},
+				WantStderr: "unknown artifact \"kb_km/unknown\" (see `q artifacts list`)\n",
+				WantErr:    fmt.Errorf("unknown artifact \"kb_km/unknown\" (see `q artifacts list`)"),
+			},
+			wantHistory: historyIDs,
+			wantLatest:  "20010204-040506.000000000-def456",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			qw := &qmkWrapper{
+				QMKDir:    t.TempDir(),
+				OutputDir: t.TempDir(),
+			}
+
+			// Each artifact's contents are its ID so restores are easy to verify.
+			for i, id := range historyIDs {
+				commit := strings.SplitN(id, "-", 3)[2]
+				m := newManifest("kb", "km", commit, "bin", false, []byte(id))
+				m.Timestamp = time.Date(2001, 2, 3+i, 4, 5, 6, 0, time.UTC)
+				if err := qw.archiveArtifact("kb_km.bin", []byte(id), m); err != nil {
+					t.Fatalf("failed to archive artifact: %v", err)
+				}
+				if i == 1 {
+					if _, err := copyFile(qw.historyFile("kb_km", id, "bin"), filepath.Join(qw.OutputDir, "kb_km.bin")); err != nil {
+						t.Fatalf("failed to copy latest artifact: %v", err)
+					}
+					if err := writeManifest(filepath.Join(qw.OutputDir, "kb_km.bin"), m); err != nil {
+						t.Fatalf("failed to write latest manifest: %v", err)
+					}
+				}
+			}
+
+			test.etc.Node = qw.Node()
+			commandertest.ExecuteTest(t, test.etc)
+
+			entries, err := qw.history()
+			if err != nil {
+				t.Fatalf("history() returned error: %v", err)
+			}
+			var gotHistory []string
+			for _, he := range entries {
+				gotHistory = append([]string{he.id}, gotHistory...)
+			}
+			if diff := cmp.Diff(test.wantHistory, gotHistory); diff != "" {
+				t.Errorf("%v resulted in wrong history (-want, +got):\n%s", test.etc.Args, diff)
+			}
+
+			latest, err := os.ReadFile(filepath.Join(qw.OutputDir, "kb_km.bin"))
+			if err != nil {
+				t.Fatalf("failed to read latest artifact: %v", err)
+			}
+			if diff := cmp.Diff(test.wantLatest, string(latest)); diff != "" {
+				t.Errorf("%v resulted in wrong latest artifact (-want, +got):\n%s", test.etc.Args, diff)
+			}
+		})
+	}
+}
+
+func TestArchiveArtifactDoesNotOverwrite(t *testing.T) {
+	qw := &qmkWrapper{OutputDir: t.TempDir()}
+	m := newManifest("kb", "km", "abc123", "bin", false, []byte("one"))
+	m.Timestamp = time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	for _, data := range []string{"one", "two", "three"} {
+		if err := qw.archiveArtifact("kb_km.bin", []byte(data), m); err != nil {
+			t.Fatalf("failed to archive artifact: %v", err)
+		}
+	}
+
+	entries, err := qw.history()
+	if err != nil {
+		t.Fatalf("history() returned error: %v", err)
+	}
+	var got []string
+	for _, he := range entries {
+		got = append(got, he.ID())
+	}
+	want := []string{
+		"kb_km/20010203-040506.000000007-abc123-3.bin",
+		"kb_km/20010203-040506.000000007-abc123-2.bin",
+		"kb_km/20010203-040506.000000007-abc123.bin",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("archiveArtifact() resulted in wrong history (-want, +got):\n%s", diff)
+	}
+}
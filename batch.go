@@ -0,0 +1,157 @@
+package qmkwrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+// Target is a keyboard and keymap pair compiled as part of a batch.
+type Target struct {
+	Keyboard string `json:"keyboard"`
+	Keymap   string `json:"keymap"`
+	// Artifact is the artifact type to copy. Defaults to the value of the
+	// `--hex-file` flag.
+	Artifact string `json:"artifact,omitempty"`
+}
+
+func (t *Target) String() string {
+	return fmt.Sprintf("%s:%s", t.Keyboard, t.Keymap)
+}
+
+type batchResult struct {
+	target   *Target
+	duration time.Duration
+	err      error
+}
+
+func readTargets(file string) ([]*Target, error) {
+	data, err := osReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %v", err)
+	}
+	var targets []*Target
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse targets file: %v", err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets provided")
+	}
+	for i, t := range targets {
+		if t.Keyboard == "" || t.Keymap == "" {
+			return nil, fmt.Errorf("target %d is missing a keyboard or keymap", i)
+		}
+		if t.Artifact != "" {
+			if err := validateArtifact(t.Artifact); err != nil {
+				return nil, fmt.Errorf("target %d: %v", i, err)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// batch compiles all targets in the targets file with a bounded number of
+// concurrent workers. All targets share the code file, so it is written once
+// before any compilation starts and only removed after all have finished.
+func (qw *qmkWrapper) batch(o command.Output, d *command.Data, version string) error {
+	workers := workersFlag.Get(d)
+	if workers <= 0 {
+		return o.Err(fmt.Errorf("workers must be positive; got %d", workers))
+	}
+
+	targets, err := readTargets(targetsFileArg.Get(d))
+	if err != nil {
+		return o.Err(err)
+	}
+
+	codes, err := qw.codes(o, d)
+	if err != nil {
+		return o.Err(err)
+	}
+	cleanup, err := qw.writeCodeFile(o, d, codes, version, "", "")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	results := make([]*batchResult, len(targets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = qw.compileTarget(o, d, targets[i], version)
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return printBatchResults(o, results)
+}
+
+func (qw *qmkWrapper) compileTarget(o command.Output, d *command.Data, t *Target, version string) *batchResult {
+	start := timeNow()
+	err := qw.buildTarget(o, d, t, version)
+	return &batchResult{
+		target:   t,
+		duration: timeNow().Sub(start),
+		err:      err,
+	}
+}
+
+func (qw *qmkWrapper) buildTarget(o command.Output, d *command.Data, t *Target, version string) error {
+	p := qw.profile()
+	start := timeNow()
+	lines, err := qw.qmkCompile(o, d, t.Keyboard, t.Keymap, false)
+	if err != nil {
+		return fmt.Errorf("failed to run qmk compile: %v", err)
+	}
+	if err := qw.checkSizeBudget(t.Keyboard, parseFirmwareSize(lines)); err != nil {
+		return err
+	}
+
+	var af string
+	if t.Artifact != "" {
+		af = artifactName(t.Keyboard, t.Keymap, t.Artifact)
+	} else {
+		af = qw.artifactFile(d, p.QMKDir, t.Keyboard, t.Keymap, start)
+	}
+	_, err = qw.saveArtifact(d, t.Keyboard, t.Keymap, af, version)
+	return err
+}
+
+func printBatchResults(o command.Output, results []*batchResult) error {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tRESULT\tDURATION")
+	var failures []string
+	for _, r := range results {
+		res := "PASS"
+		if r.err != nil {
+			res = "FAIL"
+			failures = append(failures, fmt.Sprintf("%s: %v", r.target, r.err))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.target, res, r.duration.Round(100*time.Millisecond))
+	}
+	tw.Flush()
+	o.Stdout(sb.String())
+
+	if len(failures) == 0 {
+		return nil
+	}
+	for _, f := range failures {
+		o.Stderrln(f)
+	}
+	return o.Err(fmt.Errorf("%d of %d targets failed", len(failures), len(results)))
+}
@@ -0,0 +1,156 @@
+package qmkwrapper
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultCipher = "rot"
+)
+
+var (
+	ciphers = map[string]Cipher{
+		"rot": &rotCipher{
+			name: "rot",
+			size: normalizedMaxRune,
+		},
+		"rot-v2": &rotCipher{
+			name: "rot-v2",
+			size: normalizedMaxRune + 1,
+		},
+		"xor": &xorCipher{},
+	}
+)
+
+// Cipher obfuscates codes before they are written to the code file.
+type Cipher interface {
+	// Name is the name of the cipher. It is written to the code file (as
+	// LEEP_CIPHER) so the firmware knows how to decode the codes.
+	Name() string
+	// Encode encodes the data with the key.
+	Encode(data, key string) (string, error)
+	// Decode reverses Encode.
+	Decode(data, key string) (string, error)
+	// Validate returns an error if the string contains characters the
+	// cipher can't encode.
+	Validate(s string) error
+}
+
+func cipherNames() []string {
+	var names []string
+	for n := range ciphers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getCipher(name string) (Cipher, error) {
+	c, ok := ciphers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher %q (must be one of [%s])", name, strings.Join(cipherNames(), ", "))
+	}
+	return c, nil
+}
+
+// validateCode checks that the code and its hash key can be encoded by the cipher.
+func validateCode(c Cipher, slot, key, code string) error {
+	if err := c.Validate(key); err != nil {
+		return fmt.Errorf("invalid hash key for code %s: %v", slot, err)
+	}
+	if err := c.Validate(code); err != nil {
+		return fmt.Errorf("invalid code %s: %v", slot, err)
+	}
+	return nil
+}
+
+// rotCipher shifts each character by the corresponding key character
+// (wrapping around an alphabet of size characters starting at minRune).
+// "rot" only covers ' ' through '}' and is kept for backwards compatibility;
+// "rot-v2" covers all printable ASCII characters.
+type rotCipher struct {
+	name string
+	size rune
+}
+
+func (rc *rotCipher) Name() string { return rc.name }
+
+func (rc *rotCipher) Encode(data, key string) (string, error) {
+	if err := rc.validate(data, key); err != nil {
+		return "", err
+	}
+	return rotN(data, key, true, rc.size), nil
+}
+
+func (rc *rotCipher) Decode(data, key string) (string, error) {
+	if err := rc.validate(data, key); err != nil {
+		return "", err
+	}
+	return rotN(data, key, false, rc.size), nil
+}
+
+func (rc *rotCipher) Validate(s string) error {
+	max := minRune + rc.size - 1
+	for i, c := range []rune(s) {
+		if c < minRune || c > max {
+			return fmt.Errorf("invalid character %q at position %d (%s only supports %q through %q)", c, i+1, rc.name, rune(minRune), max)
+		}
+	}
+	return nil
+}
+
+func (rc *rotCipher) validate(data, key string) error {
+	if err := rc.Validate(data); err != nil {
+		return fmt.Errorf("invalid data: %v", err)
+	}
+	if err := rc.Validate(key); err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+	return nil
+}
+
+// xorCipher xors the data with a keystream derived from the key (SHA-256 of
+// the key and a block counter) and hex encodes the result.
+type xorCipher struct{}
+
+func (*xorCipher) Name() string { return "xor" }
+
+// Validate always succeeds because xor operates on raw bytes.
+func (*xorCipher) Validate(string) error { return nil }
+
+func (*xorCipher) Encode(data, key string) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	return hex.EncodeToString(xorKeystream([]byte(data), key)), nil
+}
+
+func (*xorCipher) Decode(data, key string) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid xor data: %v", err)
+	}
+	return string(xorKeystream(b, key)), nil
+}
+
+func xorKeystream(data []byte, key string) []byte {
+	r := make([]byte, len(data))
+	var block [sha256.Size]byte
+	for i := range data {
+		if i%sha256.Size == 0 {
+			counter := make([]byte, 4)
+			binary.BigEndian.PutUint32(counter, uint32(i/sha256.Size))
+			block = sha256.Sum256(append([]byte(key), counter...))
+		}
+		r[i] = data[i] ^ block[i%sha256.Size]
+	}
+	return r
+}
@@ -0,0 +1,135 @@
+package qmkwrapper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCiphers(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		cipher string
+		data   string
+		key    string
+		want   string
+		// wantErr is the error returned by getCipher or Cipher.Encode.
+		wantErr string
+	}{
+		{
+			name:   "rot cipher",
+			cipher: "rot",
+			data:   "12345678",
+			key:    "ady4",
+			want:   "rv.Hvz2L",
+		},
+		{
+			name:   "rot cipher with empty key",
+			cipher: "rot",
+			data:   "12345678",
+		},
+		{
+			name:   "rot-v2 cipher",
+			cipher: "rot-v2",
+			data:   "12345678",
+			key:    "ady4",
+			want:   "rv-Hvz1L",
+		},
+		{
+			name:   "rot-v2 cipher supports tilde",
+			cipher: "rot-v2",
+			data:   "a~b~",
+			key:    "~~",
+			want:   "`}a}",
+		},
+		{
+			name:    "rot cipher fails on tilde",
+			cipher:  "rot",
+			data:    "12345678",
+			key:     "ab~",
+			wantErr: `invalid key: invalid character '~' at position 3 (rot only supports ' ' through '}')`,
+		},
+		{
+			name:    "rot-v2 cipher fails on tab",
+			cipher:  "rot-v2",
+			data:    "12\t45678",
+			key:     "ady4",
+			wantErr: `invalid data: invalid character '\t' at position 3 (rot-v2 only supports ' ' through '~')`,
+		},
+		{
+			name:    "rot-v2 cipher fails on non-ASCII characters",
+			cipher:  "rot-v2",
+			data:    "12345678",
+			key:     "café",
+			wantErr: `invalid key: invalid character 'é' at position 4 (rot-v2 only supports ' ' through '~')`,
+		},
+		{
+			name:   "xor cipher",
+			cipher: "xor",
+			data:   "hello",
+			key:    "k",
+			want:   "aad0f6a87e",
+		},
+		{
+			name:   "xor cipher with data longer than one keystream block",
+			cipher: "xor",
+			data:   strings.Repeat("z", 40),
+			key:    "k",
+			want:   "b8cfe0be6b93178e01a2e5866143d5d9d0436de05c9b5b584cde980e19e25cc34785461c52731519",
+		},
+		{
+			name:   "xor cipher with empty key",
+			cipher: "xor",
+			data:   "hello",
+		},
+		{
+			name:    "unknown cipher",
+			cipher:  "rot13",
+			wantErr: `unknown cipher "rot13" (must be one of [rot, rot-v2, xor])`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var gotErr string
+			c, err := getCipher(test.cipher)
+			var got string
+			if err == nil {
+				if diff := cmp.Diff(test.cipher, c.Name()); diff != "" {
+					t.Errorf("Cipher.Name() returned wrong value (-want, +got):\n%s", diff)
+				}
+				got, err = c.Encode(test.data, test.key)
+			}
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Fatalf("getCipher(%s).Encode(%s, %s) returned wrong error (-want, +got):\n%s", test.cipher, test.data, test.key, diff)
+			}
+			if err != nil {
+				return
+			}
+
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Cipher.Encode(%s, %s) returned wrong value (-want, +got):\n%s", test.data, test.key, diff)
+			}
+
+			if test.key == "" {
+				return
+			}
+			decoded, err := c.Decode(got, test.key)
+			if err != nil {
+				t.Fatalf("Cipher.Decode(%s, %s) returned error: %v", got, test.key, err)
+			}
+			if diff := cmp.Diff(test.data, decoded); diff != "" {
+				t.Errorf("Cipher.Decode(%s, %s) returned wrong value (-want, +got):\n%s", got, test.key, diff)
+			}
+		})
+	}
+}
+
+func TestXorCipherDecodeError(t *testing.T) {
+	_, err := (&xorCipher{}).Decode("not hex", "k")
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid xor data: ") {
+		t.Errorf("xorCipher.Decode() returned wrong error: %v", err)
+	}
+}
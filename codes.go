@@ -0,0 +1,142 @@
+package qmkwrapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+)
+
+var (
+	// Var so can stub out in tests
+	readSecret = readStdinSecret
+
+	// stdinReader is shared by all reads so input buffered by one read (e.g.
+	// several lines piped to stdin) is available to the next.
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+// embeddedKey returns the hash key embedded in the CLI for the code slot.
+func (qw *qmkWrapper) embeddedKey(name string) (string, error) {
+	cs, err := qw.slot(name)
+	if err != nil {
+		return "", err
+	}
+	if cs.HashKey == "" {
+		return "", fmt.Errorf("no hash key is embedded for code %s", name)
+	}
+	return cs.HashKey, nil
+}
+
+// encodeCode prints the value that `--hash` would write to the code file for
+// the code read from stdin.
+func (qw *qmkWrapper) encodeCode(o command.Output, d *command.Data) error {
+	n := codeSlotArg.Get(d)
+	key, c, err := qw.codeCipher(d, n)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	input, err := readSecret(o, fmt.Sprintf("Code %s: ", n))
+	if err != nil {
+		return o.Annotate(err, "failed to read code")
+	}
+	if err := validateCode(c, n, key, input); err != nil {
+		return o.Err(err)
+	}
+
+	// Same argument order as writeCodeFile so the output matches the code file.
+	r, err := c.Encode(key, input)
+	if err != nil {
+		return o.Annotatef(err, "failed to encode code %s", n)
+	}
+	o.Stdoutln(r)
+	return nil
+}
+
+// decodeCode prints the value that the encoded code read from stdin decodes
+// to with the embedded hash key. Codes are the key when encoding (see
+// encodeCode), so the rot ciphers decode to the code repeated to the length of
+// the hash key. xor codes can't be decoded without the code itself.
+func (qw *qmkWrapper) decodeCode(o command.Output, d *command.Data) error {
+	n := codeSlotArg.Get(d)
+	key, c, err := qw.codeCipher(d, n)
+	if err != nil {
+		return o.Err(err)
+	}
+	if _, ok := c.(*rotCipher); !ok {
+		return o.Err(fmt.Errorf("%s codes can't be decoded with the hash key", c.Name()))
+	}
+
+	input, err := readSecret(o, fmt.Sprintf("Encoded code %s: ", n))
+	if err != nil {
+		return o.Annotate(err, "failed to read encoded code")
+	}
+
+	r, err := c.Decode(input, key)
+	if err != nil {
+		return o.Annotatef(err, "failed to decode code %s", n)
+	}
+	o.Stdoutln(r)
+	return nil
+}
+
+// codeCipher returns the embedded hash key for the code slot and the cipher
+// to encode codes with.
+func (qw *qmkWrapper) codeCipher(d *command.Data, n string) (string, Cipher, error) {
+	key, err := qw.embeddedKey(n)
+	if err != nil {
+		return "", nil, err
+	}
+	c, err := qw.cipher(d)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, c, nil
+}
+
+// readStdinSecret reads a line from stdin. If stdin is a terminal, the prompt
+// is displayed and the input isn't echoed (so secrets never need to be passed
+// as arguments and end up in shell history).
+func readStdinSecret(o command.Output, prompt string) (string, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat stdin: %v", err)
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		o.Stderr(prompt)
+		if err := stty("-echo"); err != nil {
+			return "", fmt.Errorf("failed to disable terminal echo: %v", err)
+		}
+		restoreEcho := func() {
+			stty("echo")
+			o.Stderrln()
+		}
+		// Don't leave the terminal without echo if the prompt is interrupted.
+		stop := scrubOnSignal(func(os.Signal) { restoreEcho() })
+		defer func() {
+			stop()
+			restoreEcho()
+		}()
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("no input provided")
+	}
+	return line, nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,246 @@
+package qmkwrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// keyboardCacheTTL is how long the keyboards in a QMK directory are cached
+	// (the cache is also refreshed when the keyboards directory changes).
+	keyboardCacheTTL = 24 * time.Hour
+	// keyboardCacheDepth is how many levels of directories below the keyboards
+	// directory are checked for changes (e.g. 2 covers a new keyboard in a
+	// vendor directory and a new revision of an existing keyboard).
+	keyboardCacheDepth = 2
+)
+
+var (
+	// Vars so can stub out in tests
+	osUserCacheDir = os.UserCacheDir
+
+	// keyboardFiles are the files that make a directory in the keyboards
+	// directory a keyboard.
+	keyboardFiles = map[string]bool{
+		"keyboard.json": true,
+		"info.json":     true,
+		"rules.mk":      true,
+	}
+)
+
+// keyboardCache is the keyboards in a QMK directory. Keyboards are cached
+// since walking the keyboards directory is too slow for completion.
+type keyboardCache struct {
+	// ModTime is the newest modification time of the keyboards directory
+	// (see keyboardsModTime) when the keyboards were listed.
+	ModTime   time.Time
+	Timestamp time.Time
+	Keyboards []string
+}
+
+// completeKeyboard completes keyboards in the QMK directory one directory at
+// a time (e.g. `splitkb/` then `splitkb/kyria/` then `splitkb/kyria/rev3`).
+func (qw *qmkWrapper) completeKeyboard(value string, d *command.Data) (*command.Completion, error) {
+	kbs, err := qw.keyboards()
+	if err != nil {
+		return nil, err
+	}
+	return &command.Completion{
+		Suggestions: keyboardSuggestions(kbs, value),
+	}, nil
+}
+
+// completeKeymap completes the keymaps for the keyboard.
+func (qw *qmkWrapper) completeKeymap(kb string) *command.Completion {
+	return &command.Completion{
+		Suggestions: qw.keymaps(kb),
+	}
+}
+
+// keyboardSuggestions returns the keyboards that start with value, cut off
+// after the next directory.
+func keyboardSuggestions(kbs []string, value string) []string {
+	start := strings.LastIndex(value, "/") + 1
+	seen := map[string]bool{}
+	var r []string
+	for _, kb := range kbs {
+		if !strings.HasPrefix(kb, value) {
+			continue
+		}
+		if i := strings.Index(kb[start:], "/"); i >= 0 {
+			kb = kb[:start+i+1]
+		}
+		if !seen[kb] {
+			seen[kb] = true
+			r = append(r, kb)
+		}
+	}
+	return r
+}
+
+// keyboards returns the keyboards in the QMK directory (from the cache if it
+// is still valid).
+func (qw *qmkWrapper) keyboards() ([]string, error) {
+	qmkDir := qw.profile().QMKDir
+	root := filepath.Join(qmkDir, "keyboards")
+	mt, err := keyboardsModTime(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyboards directory: %v", err)
+	}
+
+	f, caches := readKeyboardCaches()
+	if c, ok := caches[qmkDir]; ok && c.ModTime.Equal(mt) && timeNow().Sub(c.Timestamp) < keyboardCacheTTL {
+		return c.Keyboards, nil
+	}
+
+	kbs, err := listKeyboards(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keyboards: %v", err)
+	}
+	// Completion still works if the cache can't be written, it's just slower.
+	if f != "" {
+		caches[qmkDir] = &keyboardCache{mt, timeNow(), kbs}
+		writeKeyboardCaches(f, caches)
+	}
+	return kbs, nil
+}
+
+// keyboardsModTime returns the newest modification time of the keyboards
+// directory and the directories up to keyboardCacheDepth levels below it.
+// Adding a keyboard changes its parent directory's modification time, and
+// this is much faster than listing the keyboards.
+func keyboardsModTime(root string) (time.Time, error) {
+	fi, err := osStat(root)
+	if err != nil {
+		return time.Time{}, err
+	}
+	mt := fi.ModTime()
+	dirs := []string{root}
+	for depth := 0; depth < keyboardCacheDepth; depth++ {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if !e.IsDir() || e.Name() == "keymaps" {
+					continue
+				}
+				info, err := e.Info()
+				if err != nil {
+					continue
+				}
+				if info.ModTime().After(mt) {
+					mt = info.ModTime()
+				}
+				next = append(next, filepath.Join(dir, e.Name()))
+			}
+		}
+		dirs = next
+	}
+	return mt, nil
+}
+
+// readKeyboardCaches returns the keyboard cache file and the cached keyboards
+// for each QMK directory. The file is empty if there is no cache directory.
+func readKeyboardCaches() (string, map[string]*keyboardCache) {
+	caches := map[string]*keyboardCache{}
+	dir, err := osUserCacheDir()
+	if err != nil {
+		return "", caches
+	}
+	f := filepath.Join(dir, "qmkwrapper", "keyboards.json")
+	b, err := osReadFile(f)
+	if err != nil {
+		return f, caches
+	}
+	// A corrupt cache is replaced.
+	if err := json.Unmarshal(b, &caches); err != nil {
+		return f, map[string]*keyboardCache{}
+	}
+	return f, caches
+}
+
+func writeKeyboardCaches(f string, caches map[string]*keyboardCache) {
+	b, err := json.Marshal(caches)
+	if err != nil {
+		return
+	}
+	if err := osMkdirAll(filepath.Dir(f), 0755); err != nil {
+		return
+	}
+	osWriteFile(f, b, 0644)
+}
+
+// listKeyboards returns the keyboards (directories containing any of the
+// keyboardFiles) in the keyboards directory.
+func listKeyboards(root string) ([]string, error) {
+	seen := map[string]bool{}
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			// Keymaps can have rules.mk files too.
+			if de.Name() == "keymaps" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !keyboardFiles[de.Name()] {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil || rel == "." {
+			return err
+		}
+		seen[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var kbs []string
+	for kb := range seen {
+		kbs = append(kbs, kb)
+	}
+	sort.Strings(kbs)
+	return kbs, nil
+}
+
+// keymaps returns the keymaps for the keyboard. Like keymapDir, this includes
+// keymaps in parent directories of the keyboard, as well as keymaps in the
+// userspace's keyboards directory.
+func (qw *qmkWrapper) keymaps(kb string) []string {
+	qmkDir := qw.profile().QMKDir
+	seen := map[string]bool{}
+	var kms []string
+	for _, root := range []string{
+		filepath.Join(qmkDir, "keyboards"),
+		filepath.Join(qmkDir, qw.userspace(), "keyboards"),
+	} {
+		for dir := filepath.Join(root, kb); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+			entries, err := os.ReadDir(filepath.Join(dir, "keymaps"))
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.IsDir() && !seen[e.Name()] {
+					seen[e.Name()] = true
+					kms = append(kms, e.Name())
+				}
+			}
+		}
+	}
+	sort.Strings(kms)
+	return kms
+}
@@ -0,0 +1,184 @@
+package qmkwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/commandtest"
+)
+
+// writeTestFiles creates the (empty) files in dir.
+func writeTestFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		f = filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatalf("failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+}
+
+func TestKeyboardSuggestions(t *testing.T) {
+	kbs := []string{
+		"crkbd",
+		"planck/rev6",
+		"splitkb/kyria",
+		"splitkb/kyria/rev1",
+		"splitkb/kyria/rev3",
+	}
+	for _, test := range []struct {
+		value string
+		want  []string
+	}{
+		{
+			want: []string{"crkbd", "planck/", "splitkb/"},
+		},
+		{
+			value: "s",
+			want:  []string{"splitkb/"},
+		},
+		{
+			value: "splitkb/",
+			want:  []string{"splitkb/kyria", "splitkb/kyria/"},
+		},
+		{
+			value: "splitkb/kyria/",
+			want:  []string{"splitkb/kyria/rev1", "splitkb/kyria/rev3"},
+		},
+		{
+			value: "splitkb/kyria/rev3",
+			want:  []string{"splitkb/kyria/rev3"},
+		},
+		{
+			value: "other",
+		},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, keyboardSuggestions(kbs, test.value)); diff != "" {
+				t.Errorf("keyboardSuggestions(%q) returned diff (-want, +got):\n%s", test.value, diff)
+			}
+		})
+	}
+}
+
+func TestKeyboards(t *testing.T) {
+	qmkDir := t.TempDir()
+	writeTestFiles(t, qmkDir,
+		filepath.Join("keyboards", "crkbd", "keyboard.json"),
+		filepath.Join("keyboards", "planck", "rev6", "info.json"),
+		filepath.Join("keyboards", "planck", "rev6", "rules.mk"),
+		filepath.Join("keyboards", "planck", "keymaps", "default", "rules.mk"),
+		filepath.Join("keyboards", "splitkb", "kyria", "rules.mk"),
+		filepath.Join("keyboards", "splitkb", "kyria", "rev3", "keyboard.json"),
+		filepath.Join("keyboards", "splitkb", "readme.md"),
+	)
+	cacheDir := t.TempDir()
+	commandtest.StubValue(t, &osUserCacheDir, func() (string, error) { return cacheDir, nil })
+	now := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	commandtest.StubValue(t, &timeNow, func() time.Time { return now })
+
+	qw := &qmkWrapper{QMKDir: qmkDir}
+	want := []string{"crkbd", "planck/rev6", "splitkb/kyria", "splitkb/kyria/rev3"}
+	check := func(want []string) {
+		t.Helper()
+		got, err := qw.keyboards()
+		if err != nil {
+			t.Fatalf("keyboards() returned error: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("keyboards() returned diff (-want, +got):\n%s", diff)
+		}
+	}
+	check(want)
+
+	// touch sets the directory's modification time to a later time (so the
+	// change is detected regardless of the file system's time resolution).
+	mt := time.Now()
+	touch := func(dir string) {
+		t.Helper()
+		mt = mt.Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(qmkDir, "keyboards", dir), mt, mt); err != nil {
+			t.Fatalf("failed to set modification time: %v", err)
+		}
+	}
+
+	// Keyboards are cached (deeply nested keyboards don't change the
+	// modification times of the checked directories).
+	writeTestFiles(t, qmkDir, filepath.Join("keyboards", "splitkb", "kyria", "rev3", "left", "keyboard.json"))
+	check(want)
+
+	// The cache expires.
+	now = now.Add(keyboardCacheTTL)
+	want = []string{"crkbd", "planck/rev6", "splitkb/kyria", "splitkb/kyria/rev3", "splitkb/kyria/rev3/left"}
+	check(want)
+
+	// The cache is refreshed when a keyboard is added to a vendor directory.
+	writeTestFiles(t, qmkDir, filepath.Join("keyboards", "splitkb", "aurora", "keyboard.json"))
+	touch("splitkb")
+	want = []string{"crkbd", "planck/rev6", "splitkb/aurora", "splitkb/kyria", "splitkb/kyria/rev3", "splitkb/kyria/rev3/left"}
+	check(want)
+
+	// The cache is refreshed when a revision is added to a keyboard.
+	writeTestFiles(t, qmkDir, filepath.Join("keyboards", "splitkb", "kyria", "rev4", "keyboard.json"))
+	touch(filepath.Join("splitkb", "kyria"))
+	want = []string{"crkbd", "planck/rev6", "splitkb/aurora", "splitkb/kyria", "splitkb/kyria/rev3", "splitkb/kyria/rev3/left", "splitkb/kyria/rev4"}
+	check(want)
+
+	// The cache is refreshed when the keyboards directory changes.
+	writeTestFiles(t, qmkDir, filepath.Join("keyboards", "zz", "info.json"))
+	touch(".")
+	check(append(want, "zz"))
+
+	// Keyboards are listed without a cache directory.
+	commandtest.StubValue(t, &osUserCacheDir, func() (string, error) { return "", os.ErrNotExist })
+	check(append(want, "zz"))
+}
+
+func TestKeymaps(t *testing.T) {
+	qmkDir := t.TempDir()
+	writeTestFiles(t, qmkDir,
+		filepath.Join("keyboards", "splitkb", "kyria", "keymaps", "default", "keymap.c"),
+		filepath.Join("keyboards", "splitkb", "kyria", "rev3", "keymaps", "via", "keymap.c"),
+		filepath.Join("keyboards", "splitkb", "kyria", "rev3", "keymaps", "default", "keymap.c"),
+		filepath.Join("keyboards", "planck", "keymaps", "other", "keymap.c"),
+		filepath.Join(userspaceDir, "keyboards", "splitkb", "kyria", "keymaps", "leep", "keymap.c"),
+	)
+
+	for _, test := range []struct {
+		name string
+		kb   string
+		want []string
+	}{
+		{
+			name: "lists keymaps for keyboard, parents, and userspace",
+			kb:   "splitkb/kyria/rev3",
+			want: []string{"default", "leep", "via"},
+		},
+		{
+			name: "lists keymaps for parent keyboard",
+			kb:   "splitkb/kyria",
+			want: []string{"default", "leep"},
+		},
+		{
+			name: "no keymaps for unknown keyboard",
+			kb:   "crkbd",
+		},
+		{
+			name: "doesn't look outside of keyboards directory",
+			kb:   "../..",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			qw := &qmkWrapper{QMKDir: qmkDir}
+			if diff := cmp.Diff(test.want, qw.keymaps(test.kb)); diff != "" {
+				t.Errorf("keymaps(%s) returned diff (-want, +got):\n%s", test.kb, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// uf2InfoFile is the file every UF2 bootloader drive contains.
+	uf2InfoFile = "INFO_UF2.TXT"
+)
+
+var (
+	// Vars so can stub out in tests
+	deployPollInterval = 500 * time.Millisecond
+	deployTimeout      = 2 * time.Minute
+)
+
+// deployDir returns the directory to copy uf2 artifacts to (the
+// `--deploy-dir` flag, then the profile's deploy directory).
+func (qw *qmkWrapper) deployDir(d *command.Data) string {
+	if deployDirFlag.Provided(d) {
+		return deployDirFlag.Get(d)
+	}
+	return qw.profile().DeployDir
+}
+
+// findUF2Drive returns the UF2 drive in dir (dir itself or one of its
+// subdirectories, e.g. /media/<user>/RPI-RP2 for /media/<user>). An empty
+// string is returned if there isn't one.
+func findUF2Drive(dir string) string {
+	if _, err := osStat(filepath.Join(dir, uf2InfoFile)); err == nil {
+		return dir
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := osStat(filepath.Join(dir, e.Name(), uf2InfoFile)); err == nil {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return ""
+}
+
+// waitForUF2Drive polls dir until a UF2 drive is mounted in it.
+func waitForUF2Drive(dir string) (string, error) {
+	deadline := timeNow().Add(deployTimeout)
+	for {
+		if drive := findUF2Drive(dir); drive != "" {
+			return drive, nil
+		}
+		if !timeNow().Before(deadline) {
+			return "", fmt.Errorf("timed out after %v waiting for a UF2 drive (a directory containing %s) in %s", deployTimeout, uf2InfoFile, dir)
+		}
+		timeSleep(deployPollInterval)
+	}
+}
+
+// deploy copies the uf2 artifact to the UF2 drive once the keyboard is put
+// into bootloader mode.
+func (qw *qmkWrapper) deploy(o command.Output, file, dir string) error {
+	o.Stdoutf("Waiting for a UF2 drive in %s (put the keyboard into bootloader mode)\n", dir)
+	drive, err := waitForUF2Drive(dir)
+	if err != nil {
+		return o.Err(err)
+	}
+	if _, err := copyFile(file, filepath.Join(drive, filepath.Base(file))); err != nil {
+		return o.Annotatef(err, "failed to copy %s to %s", file, drive)
+	}
+	o.Stdoutf("Successfully copied %s to %s\n", file, drive)
+	return nil
+}
@@ -0,0 +1,100 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/commandtest"
+)
+
+func TestWaitForUF2Drive(t *testing.T) {
+	mountDrive := func(t *testing.T, dir string) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create drive directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, uf2InfoFile), []byte("UF2 Bootloader"), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", uf2InfoFile, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		// setup mounts drives in the directory before waiting.
+		setup func(t *testing.T, dir string)
+		// mountAfter is the number of polls after which RPI-RP2 is mounted (0
+		// to never mount it).
+		mountAfter int
+		// want is the drive relative to the directory.
+		want      string
+		wantErr   string
+		wantSleep int
+	}{
+		{
+			name: "finds drive in directory",
+			setup: func(t *testing.T, dir string) {
+				mountDrive(t, dir)
+			},
+		},
+		{
+			name: "finds drive in subdirectory",
+			setup: func(t *testing.T, dir string) {
+				if err := os.MkdirAll(filepath.Join(dir, "USB"), 0755); err != nil {
+					t.Fatalf("failed to create directory: %v", err)
+				}
+				mountDrive(t, filepath.Join(dir, "RPI-RP2"))
+			},
+			want: "RPI-RP2",
+		},
+		{
+			name:       "waits for drive to be mounted",
+			mountAfter: 3,
+			want:       "RPI-RP2",
+			wantSleep:  3,
+		},
+		{
+			name:      "times out if drive isn't mounted",
+			wantErr:   "timed out after 2s waiting for a UF2 drive (a directory containing INFO_UF2.TXT) in %s",
+			wantSleep: 4,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.setup != nil {
+				test.setup(t, dir)
+			}
+
+			now := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+			commandtest.StubValue(t, &timeNow, func() time.Time { return now })
+			commandtest.StubValue(t, &deployTimeout, 2*time.Second)
+			var gotSleep int
+			commandtest.StubValue(t, &timeSleep, func(d time.Duration) {
+				now = now.Add(d)
+				gotSleep++
+				if gotSleep == test.mountAfter {
+					mountDrive(t, filepath.Join(dir, "RPI-RP2"))
+				}
+			})
+
+			got, err := waitForUF2Drive(dir)
+			var gotErr, wantErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if test.wantErr != "" {
+				wantErr = fmt.Sprintf(test.wantErr, dir)
+			} else if diff := cmp.Diff(filepath.Join(dir, test.want), got); diff != "" {
+				t.Errorf("waitForUF2Drive() returned wrong drive (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(wantErr, gotErr); diff != "" {
+				t.Errorf("waitForUF2Drive() returned wrong error (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantSleep, gotSleep); diff != "" {
+				t.Errorf("waitForUF2Drive() slept wrong number of times (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
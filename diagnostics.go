@@ -0,0 +1,165 @@
+package qmkwrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+var (
+	// gcc-style diagnostics (file:line:col: error: message). The column is
+	// optional (e.g. for linker errors).
+	diagnosticRegex = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning): (.*)$`)
+	// QMK marks each file it builds with [OK], [WARNINGS], or [ERRORS].
+	qmkMarkerRegex = regexp.MustCompile(`^[A-Z][a-z]+:\s+(\S+)\s+\[(ERRORS|WARNINGS)\]\s*$`)
+	// QMK colors its output.
+	ansiRegex = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// Diagnostic is an error or warning from `qmk compile`.
+type Diagnostic struct {
+	File string `json:"file"`
+	// Line and Column are zero if unknown (e.g. for QMK markers).
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// compileReport is the `--json` output of a compile.
+type compileReport struct {
+	Errors      int           `json:"errors"`
+	Warnings    int           `json:"warnings"`
+	Diagnostics []*Diagnostic `json:"diagnostics"`
+	// Size is nil if qmk didn't report the firmware size.
+	Size *FirmwareSize `json:"size,omitempty"`
+}
+
+// parseDiagnostics parses the gcc diagnostics and QMK markers in the output of
+// `qmk compile`. Files QMK marked without any gcc diagnostics get a single
+// diagnostic for the marker.
+func parseDiagnostics(lines []string) []*Diagnostic {
+	var diags []*Diagnostic
+	seen := map[Diagnostic]bool{}
+	var marked []*Diagnostic
+	for _, l := range lines {
+		l = strings.TrimRight(ansiRegex.ReplaceAllString(l, ""), "\r")
+		if m := qmkMarkerRegex.FindStringSubmatch(l); m != nil {
+			sev := severityWarning
+			if m[2] == "ERRORS" {
+				sev = severityError
+			}
+			marked = append(marked, &Diagnostic{
+				File:     m[1],
+				Severity: sev,
+				Message:  fmt.Sprintf("qmk reported %s", strings.ToLower(m[2])),
+			})
+			continue
+		}
+
+		m := diagnosticRegex.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		sev := m[4]
+		if sev == "fatal error" {
+			sev = severityError
+		}
+		diag := Diagnostic{
+			File:     m[1],
+			Line:     line,
+			Column:   col,
+			Severity: sev,
+			Message:  m[5],
+		}
+		// gcc repeats diagnostics for headers included by multiple files.
+		if seen[diag] {
+			continue
+		}
+		seen[diag] = true
+		diags = append(diags, &diag)
+	}
+
+	for _, md := range marked {
+		var found bool
+		for _, diag := range diags {
+			if diag.File == md.File {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diags = append(diags, md)
+		}
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Line < diags[j].Line
+	})
+	return diags
+}
+
+func countDiagnostics(diags []*Diagnostic) (errors, warnings int) {
+	for _, diag := range diags {
+		if diag.Severity == severityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	return errors, warnings
+}
+
+// printDiagnostics prints the diagnostics grouped by file (nothing is printed
+// if there aren't any).
+func printDiagnostics(o command.Output, diags []*Diagnostic) {
+	if len(diags) == 0 {
+		return
+	}
+	errors, warnings := countDiagnostics(diags)
+	o.Stdoutf("Diagnostics: %d error(s), %d warning(s)\n", errors, warnings)
+	var file string
+	for _, diag := range diags {
+		if diag.File != file {
+			file = diag.File
+			o.Stdoutln(file)
+		}
+		if diag.Line == 0 {
+			o.Stdoutf("  %s: %s\n", diag.Severity, diag.Message)
+		} else if diag.Column == 0 {
+			o.Stdoutf("  %d: %s: %s\n", diag.Line, diag.Severity, diag.Message)
+		} else {
+			o.Stdoutf("  %d:%d: %s: %s\n", diag.Line, diag.Column, diag.Severity, diag.Message)
+		}
+	}
+}
+
+// printCompileReport prints the diagnostics and firmware size as a JSON
+// compileReport.
+func printCompileReport(o command.Output, diags []*Diagnostic, size *FirmwareSize) error {
+	if diags == nil {
+		diags = []*Diagnostic{}
+	}
+	errors, warnings := countDiagnostics(diags)
+	b, err := json.MarshalIndent(&compileReport{errors, warnings, diags, size}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal compile report: %v", err)
+	}
+	o.Stdoutln(string(b))
+	return nil
+}
@@ -0,0 +1,97 @@
+package qmkwrapper
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		lines []string
+		want  []*Diagnostic
+	}{
+		{
+			name: "no diagnostics",
+			lines: []string{
+				"Compiling: quantum/quantum.c                                       [OK]",
+				"Linking: .build/kb_km.elf                                          [OK]",
+			},
+		},
+		{
+			name: "parses gcc diagnostics grouped by file",
+			lines: []string{
+				"Compiling: users/leep-frog/leep_frog.c                             [ERRORS]",
+				" |",
+				"users/leep-frog/leep_frog.c:12:5: error: 'LEEP_CODE_3' undeclared (first use in this function)",
+				"users/leep-frog/leep_frog.c:8:1: warning: unused variable 'x' [-Wunused-variable]",
+				"keyboards/kb/keymaps/km/keymap.c:40:10: fatal error: missing.h: No such file or directory",
+				"keyboards/kb/keymaps/km/keymap.c:40: note: ignored",
+			},
+			want: []*Diagnostic{
+				{
+					File:     "keyboards/kb/keymaps/km/keymap.c",
+					Line:     40,
+					Column:   10,
+					Severity: severityError,
+					Message:  "missing.h: No such file or directory",
+				},
+				{
+					File:     "users/leep-frog/leep_frog.c",
+					Line:     8,
+					Column:   1,
+					Severity: severityWarning,
+					Message:  "unused variable 'x' [-Wunused-variable]",
+				},
+				{
+					File:     "users/leep-frog/leep_frog.c",
+					Line:     12,
+					Column:   5,
+					Severity: severityError,
+					Message:  "'LEEP_CODE_3' undeclared (first use in this function)",
+				},
+			},
+		},
+		{
+			name: "removes duplicates and color codes",
+			lines: []string{
+				"users/leep-frog/leep_frog.h:3: warning: \x1b[01;35m\"FOO\" redefined\x1b[m",
+				"users/leep-frog/leep_frog.h:3: warning: \"FOO\" redefined",
+			},
+			want: []*Diagnostic{
+				{
+					File:     "users/leep-frog/leep_frog.h",
+					Line:     3,
+					Severity: severityWarning,
+					Message:  `"FOO" redefined`,
+				},
+			},
+		},
+		{
+			name: "adds QMK markers without gcc diagnostics",
+			lines: []string{
+				"Compiling: quantum/quantum.c                                       \x1b[33;01m[WARNINGS]\x1b[0m",
+				"Linking: .build/kb_km.elf                                          \x1b[31;01m[ERRORS]\x1b[0m",
+			},
+			want: []*Diagnostic{
+				{
+					File:     ".build/kb_km.elf",
+					Severity: severityError,
+					Message:  "qmk reported errors",
+				},
+				{
+					File:     "quantum/quantum.c",
+					Severity: severityWarning,
+					Message:  "qmk reported warnings",
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, parseDiagnostics(test.lines)); diff != "" {
+				t.Errorf("parseDiagnostics(%v) returned diff (-want, +got):\n%s", test.lines, diff)
+			}
+		})
+	}
+}
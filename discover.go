@@ -0,0 +1,110 @@
+package qmkwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// buildDir is the directory (relative to the QMK directory) where QMK
+	// puts build files.
+	buildDir = ".build"
+)
+
+var (
+	// artifactExts are the extensions of the flashable artifacts QMK builds.
+	artifactExts = map[string]bool{
+		".bin": true,
+		".hex": true,
+		".uf2": true,
+	}
+
+	// converters are the QMK converters (`CONVERT_TO`), whose names QMK
+	// appends to artifact names (e.g. `<kb>_<km>_rp2040_ce.uf2`).
+	converters = map[string]bool{
+		"bit_c_pro":       true,
+		"blok":            true,
+		"bonsai_c4":       true,
+		"elite_pi":        true,
+		"helios":          true,
+		"imera":           true,
+		"kb2040":          true,
+		"liatris":         true,
+		"michi":           true,
+		"promicro_rp2040": true,
+		"proton_c":        true,
+		"rp2040_ce":       true,
+		"sparkfun_pm2040": true,
+		"stemcell":        true,
+		"svlinky":         true,
+	}
+)
+
+// artifactFile returns the path (relative to dir) of the artifact for the
+// keyboard and keymap. If the artifact type isn't provided with `--hex-file`
+// or `--artifact` or configured for the profile, the newest artifact modified
+// since start is used (so artifacts named differently by QMK, e.g. by
+// converters, are found). The default artifact name is returned if no
+// artifact is found.
+func (qw *qmkWrapper) artifactFile(d *command.Data, dir, kb, km string, start time.Time) string {
+	if hexFileFlag.Get(d) == "bin" && !artifactFlag.Provided(d) && qw.profile().Artifact == "" {
+		if f := discoverArtifact(dir, kb, km, start); f != "" {
+			return f
+		}
+	}
+	return artifactName(kb, km, qw.artifactType(d))
+}
+
+// artifactExt returns the artifact type of the artifact file.
+func artifactExt(f string) string {
+	return strings.TrimPrefix(filepath.Ext(f), ".")
+}
+
+// discoverArtifact returns the path (relative to dir) of the newest artifact
+// for the keyboard and keymap modified since start. Artifacts in dir are
+// preferred over those in its build directory, and artifacts named exactly
+// `<kb>_<km>` are preferred over those with a converter suffix. Other suffixes
+// aren't matched since they can be another keymap's artifact (e.g.
+// `<kb>_<km>_mini` built concurrently by `q batch`).
+func discoverArtifact(dir, kb, km string, start time.Time) string {
+	stem := strings.TrimSuffix(artifactName(kb, km, ""), ".")
+	// Some file systems only store modification times to the second.
+	start = start.Truncate(time.Second)
+	for _, sub := range []string{"", buildDir} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			continue
+		}
+
+		var best string
+		var bestExact bool
+		var bestTime time.Time
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || !artifactExts[filepath.Ext(name)] {
+				continue
+			}
+			s := strings.TrimSuffix(name, filepath.Ext(name))
+			exact := s == stem
+			if !exact && !(strings.HasPrefix(s, stem+"_") && converters[strings.TrimPrefix(s, stem+"_")]) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil || fi.ModTime().Before(start) {
+				continue
+			}
+			if best != "" && (bestExact && !exact || bestExact == exact && !fi.ModTime().After(bestTime)) {
+				continue
+			}
+			best, bestExact, bestTime = filepath.Join(sub, name), exact, fi.ModTime()
+		}
+		if best != "" {
+			return best
+		}
+	}
+	return ""
+}
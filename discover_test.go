@@ -0,0 +1,141 @@
+package qmkwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscoverArtifact(t *testing.T) {
+	start := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	stale := start.Add(-time.Hour)
+
+	for _, test := range []struct {
+		name string
+		kb   string
+		// files are the files in the directory and their modification times.
+		files map[string]time.Time
+		want  string
+	}{
+		{
+			name: "no artifacts",
+			kb:   "kb",
+		},
+		{
+			name: "finds artifact",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin": start,
+				"kb_km.elf": start,
+				"README.md": start,
+			},
+			want: "kb_km.bin",
+		},
+		{
+			name: "finds artifact with slashes in keyboard",
+			kb:   filepath.Join("planck", "rev6"),
+			files: map[string]time.Time{
+				"planck_rev6_km.hex": start.Add(time.Second),
+			},
+			want: "planck_rev6_km.hex",
+		},
+		{
+			name: "ignores artifacts from before the build",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin": stale,
+			},
+		},
+		{
+			name: "ignores modification times within the same second",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin": start.Truncate(time.Second),
+			},
+			want: "kb_km.bin",
+		},
+		{
+			name: "finds newest artifact",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin": start,
+				"kb_km.hex": start.Add(time.Minute),
+				"kb_km.uf2": stale,
+			},
+			want: "kb_km.hex",
+		},
+		{
+			name: "finds artifact with converter suffix",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km_rp2040_ce.uf2": start,
+				"kb_km.hex":           stale,
+			},
+			want: "kb_km_rp2040_ce.uf2",
+		},
+		{
+			name: "prefers artifact without suffix",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin":          start,
+				"kb_km_elite_pi.uf2": start.Add(time.Minute),
+			},
+			want: "kb_km.bin",
+		},
+		{
+			name: "ignores other keymaps",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_kmx.bin": start,
+			},
+		},
+		{
+			name: "ignores other keymaps with suffix",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km_mini.bin": start,
+			},
+		},
+		{
+			name: "finds artifact in build directory",
+			kb:   "kb",
+			files: map[string]time.Time{
+				filepath.Join(buildDir, "kb_km.uf2"): start,
+				filepath.Join(buildDir, "kb_km.elf"): start,
+			},
+			want: filepath.Join(buildDir, "kb_km.uf2"),
+		},
+		{
+			name: "prefers artifact in QMK directory",
+			kb:   "kb",
+			files: map[string]time.Time{
+				"kb_km.bin":                          start,
+				filepath.Join(buildDir, "kb_km.bin"): start.Add(time.Minute),
+			},
+			want: "kb_km.bin",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for f, mt := range test.files {
+				f = filepath.Join(dir, f)
+				if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+					t.Fatalf("failed to create directory: %v", err)
+				}
+				if err := os.WriteFile(f, []byte("artifact"), 0644); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+				if err := os.Chtimes(f, mt, mt); err != nil {
+					t.Fatalf("failed to set modification time: %v", err)
+				}
+			}
+
+			if diff := cmp.Diff(test.want, discoverArtifact(dir, test.kb, "km", start)); diff != "" {
+				t.Errorf("discoverArtifact(%s, %s, km) returned diff (-want, +got):\n%s", dir, test.kb, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commander"
+)
+
+const (
+	// testTarget is the make target that runs the userspace tests (`q test`).
+	testTarget = "test:leep_frog"
+)
+
+var (
+	// Var so can stub out in tests
+	execLookPath = exec.LookPath
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// checkResult is the result of a `q doctor` check.
+type checkResult struct {
+	status  checkStatus
+	message string
+	// hint is how to fix the problem (unused for passing checks).
+	hint string
+}
+
+func passCheck(format string, a ...interface{}) *checkResult {
+	return &checkResult{checkPass, fmt.Sprintf(format, a...), ""}
+}
+
+func warnCheck(hint, format string, a ...interface{}) *checkResult {
+	return &checkResult{checkWarn, fmt.Sprintf(format, a...), hint}
+}
+
+func failCheck(hint, format string, a ...interface{}) *checkResult {
+	return &checkResult{checkFail, fmt.Sprintf(format, a...), hint}
+}
+
+// doctor checks everything compiling relies on and prints the result of
+// each check. An error is returned if any check fails.
+func (qw *qmkWrapper) doctor(o command.Output, d *command.Data) error {
+	results := []*checkResult{
+		checkExecutable("qmk", "Install the QMK CLI (https://docs.qmk.fm/newbs_getting_started)"),
+		checkExecutable("git", "Install git (https://git-scm.com/downloads)"),
+	}
+
+	p := qw.profile()
+	if p.QMKDir == "" || p.OutputDir == "" {
+		results = append(results, failCheck("Run `q config set`", "directory values have not been set"))
+	} else {
+		results = append(results,
+			qw.checkGitRepo(o, d),
+			qw.checkCodeFileDir(),
+			qw.checkCodeFileScrubbed(),
+			checkWritableDir("output directory", p.OutputDir, "Create it or update it with `q config set`"),
+			qw.checkTestTarget(o, d),
+		)
+	}
+
+	var failed int
+	for _, r := range results {
+		o.Stdoutf("[%s] %s\n", r.status, r.message)
+		if r.status != checkPass && r.hint != "" {
+			o.Stdoutf("       %s\n", r.hint)
+		}
+		if r.status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return o.Err(fmt.Errorf("%d doctor check(s) failed", failed))
+	}
+	return nil
+}
+
+func checkExecutable(name, hint string) *checkResult {
+	if _, err := execLookPath(name); err != nil {
+		return failCheck(hint, "%s is not on PATH", name)
+	}
+	return passCheck("%s is on PATH", name)
+}
+
+// checkGitRepo checks that the QMK directory is a git repo with all
+// submodules initialized.
+func (qw *qmkWrapper) checkGitRepo(o command.Output, d *command.Data) *checkResult {
+	qmkDir := qw.profile().QMKDir
+	if _, err := osStat(filepath.Join(qmkDir, ".git")); err != nil {
+		return failCheck("Clone QMK with `qmk setup` (or `git clone`) and update the directory with `q config set`", "QMK directory %s is not a git repo", qmkDir)
+	}
+
+	sc := &commander.ShellCommand[[]string]{
+		CommandName: "git",
+		Args:        []string{"submodule", "status"},
+		Dir:         qmkDir,
+		HideStderr:  true,
+	}
+	lines, err := sc.Run(o, d)
+	if err != nil {
+		return failCheck("Check that git works in the QMK directory", "failed to get submodule status: %v", err)
+	}
+	var uninitialized, outdated []string
+	for _, l := range lines {
+		l = strings.TrimRight(l, " ")
+		if l == "" {
+			continue
+		}
+		fields := strings.Fields(l[1:])
+		if len(fields) < 2 {
+			continue
+		}
+		switch l[0] {
+		case '-':
+			uninitialized = append(uninitialized, fields[1])
+		case '+':
+			outdated = append(outdated, fields[1])
+		}
+	}
+	hint := "Run `qmk git-submodule` in the QMK directory"
+	if len(uninitialized) > 0 {
+		return failCheck(hint, "submodules aren't initialized: %s", strings.Join(uninitialized, ", "))
+	}
+	if len(outdated) > 0 {
+		return warnCheck(hint, "submodules don't match the checked out commit: %s", strings.Join(outdated, ", "))
+	}
+	return passCheck("QMK directory is a git repo with initialized submodules")
+}
+
+func (qw *qmkWrapper) checkCodeFileDir() *checkResult {
+	return checkWritableDir("code file directory", filepath.Dir(qw.codeFilePath()), "Create it or update the userspace and code file with `q config set`")
+}
+
+// checkWritableDir checks that the directory exists and files can be created in it.
+func checkWritableDir(name, dir, hint string) *checkResult {
+	fi, err := osStat(dir)
+	if err != nil {
+		return failCheck(hint, "%s %s doesn't exist", name, dir)
+	}
+	if !fi.IsDir() {
+		return failCheck(hint, "%s %s is not a directory", name, dir)
+	}
+	f, err := os.CreateTemp(dir, ".q-doctor-*")
+	if err != nil {
+		return failCheck("Check the directory's permissions", "%s %s is not writable", name, dir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return passCheck("%s %s is writable", name, dir)
+}
+
+// checkCodeFileScrubbed checks that the code file doesn't contain any codes
+// from a build.
+func (qw *qmkWrapper) checkCodeFileScrubbed() *checkResult {
+	f := qw.codeFilePath()
+	b, err := osReadFile(f)
+	if os.IsNotExist(err) {
+		return passCheck("code file %s doesn't exist (it is created by the next build)", f)
+	} else if err != nil {
+		return failCheck("Check the file's permissions", "failed to read code file %s: %v", f, err)
+	}
+
+	m := leepVersionRegex.FindSubmatch(b)
+	if m == nil {
+		return warnCheck("Add a LEEP_VERSION define so leftover codes can be detected", "code file %s doesn't define LEEP_VERSION", f)
+	}
+	switch v := string(m[1]); {
+	case v == scrubbedVersion:
+		return passCheck("code file %s is scrubbed", f)
+	case isBuildVersion(v):
+		if pid := codeFileLockOwner(f); pid != 0 {
+			return passCheck("code file %s contains codes from a running build (PID %d)", f, pid)
+		}
+		return failCheck("Run any other q command to remove them (leftover codes are removed before every command except doctor)", "code file %s contains codes from an interrupted build (version %q)", f, v)
+	default:
+		return warnCheck("Make sure it doesn't contain any real codes", "code file %s is hand-maintained (version %q)", f, v)
+	}
+}
+
+func (qw *qmkWrapper) checkTestTarget(o command.Output, d *command.Data) *checkResult {
+	sc := &commander.ShellCommand[[]string]{
+		CommandName: "make",
+		Args:        []string{"-n", testTarget},
+		Dir:         qw.profile().QMKDir,
+		HideStderr:  true,
+	}
+	if _, err := sc.Run(o, d); err != nil {
+		return failCheck(fmt.Sprintf("Add the tests to %s", filepath.Join(qw.profile().QMKDir, qw.userspace())), "make target %s doesn't exist", testTarget)
+	}
+	return passCheck("make target %s exists", testTarget)
+}
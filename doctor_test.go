@@ -0,0 +1,326 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leep-frog/command/commandertest"
+	"github.com/leep-frog/command/commandtest"
+)
+
+func TestDoctor(t *testing.T) {
+	healthyQMKDir := func(codeFileContents string) func(t *testing.T, qmkDir string) {
+		return func(t *testing.T, qmkDir string) {
+			if err := os.MkdirAll(filepath.Join(qmkDir, ".git"), 0755); err != nil {
+				t.Fatalf("failed to create .git directory: %v", err)
+			}
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(qmkDir, codeFile)), 0755); err != nil {
+				t.Fatalf("failed to create code file directory: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(qmkDir, codeFile), []byte(codeFileContents), 0644); err != nil {
+				t.Fatalf("failed to write code file: %v", err)
+			}
+		}
+	}
+	leftover := strings.Join([]string{
+		"#pragma once",
+		`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+		`#define LEEP_CODE_1 "message 1"`,
+		`#define LEEP_CODE_2 "message two"`,
+		"",
+	}, "\n")
+	scrubbed := strings.Join([]string{
+		"#pragma once",
+		`#define LEEP_VERSION "auto-generated"`,
+		`#define LEEP_CODE_1 ""`,
+		`#define LEEP_CODE_2 ""`,
+		"",
+	}, "\n")
+
+	for _, test := range []struct {
+		name string
+		// setup creates the files in the QMK directory.
+		setup func(t *testing.T, qmkDir string)
+		// notOnPath are the executables that aren't installed.
+		notOnPath []string
+		// noDirs is whether the directories aren't configured.
+		noDirs bool
+		etc    func(qmkDir, outputDir string) *commandtest.ExecuteTestCase
+	}{
+		{
+			name:  "passes all checks",
+			setup: healthyQMKDir(scrubbed),
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Stdout: []string{" abc123 lib/chibios (heads/master)"}},
+						{},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "git",
+							Args: []string{"submodule", "status"},
+							Dir:  qmkDir,
+						},
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[PASS] QMK directory is a git repo with initialized submodules",
+						fmt.Sprintf("[PASS] code file directory %s is writable", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						fmt.Sprintf("[PASS] code file %s is scrubbed", filepath.Join(qmkDir, codeFile)),
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[PASS] make target test:leep_frog exists",
+						"",
+					}, "\n"),
+				}
+			},
+		},
+		{
+			name:  "warns about outdated submodules and hand-maintained code file",
+			setup: healthyQMKDir("#define LEEP_VERSION \"dev\"\n"),
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Stdout: []string{
+							" abc123 lib/chibios (heads/master)",
+							"+def456 lib/lufa (heads/master)",
+						}},
+						{},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "git",
+							Args: []string{"submodule", "status"},
+							Dir:  qmkDir,
+						},
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[WARN] submodules don't match the checked out commit: lib/lufa",
+						"       Run `qmk git-submodule` in the QMK directory",
+						fmt.Sprintf("[PASS] code file directory %s is writable", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						fmt.Sprintf("[WARN] code file %s is hand-maintained (version \"dev\")", filepath.Join(qmkDir, codeFile)),
+						"       Make sure it doesn't contain any real codes",
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[PASS] make target test:leep_frog exists",
+						"",
+					}, "\n"),
+				}
+			},
+		},
+		{
+			name:  "fails if code file contains codes from an interrupted build",
+			setup: healthyQMKDir(leftover),
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Stdout: []string{" abc123 lib/chibios (heads/master)"}},
+						{},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "git",
+							Args: []string{"submodule", "status"},
+							Dir:  qmkDir,
+						},
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[PASS] QMK directory is a git repo with initialized submodules",
+						fmt.Sprintf("[PASS] code file directory %s is writable", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						fmt.Sprintf("[FAIL] code file %s contains codes from an interrupted build (version \"2001-02-03 04:05:06 abc123\")", filepath.Join(qmkDir, codeFile)),
+						"       Run any other q command to remove them (leftover codes are removed before every command except doctor)",
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[PASS] make target test:leep_frog exists",
+						"",
+					}, "\n"),
+					WantStderr: "1 doctor check(s) failed\n",
+					WantErr:    fmt.Errorf("1 doctor check(s) failed"),
+				}
+			},
+		},
+		{
+			name: "passes if code file contains codes from a running build",
+			setup: func(t *testing.T, qmkDir string) {
+				healthyQMKDir(leftover)(t, qmkDir)
+				if err := os.WriteFile(filepath.Join(qmkDir, codeFile)+lockFileSuffix, []byte("5678"), 0644); err != nil {
+					t.Fatalf("failed to write lock file: %v", err)
+				}
+			},
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Stdout: []string{" abc123 lib/chibios (heads/master)"}},
+						{},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "git",
+							Args: []string{"submodule", "status"},
+							Dir:  qmkDir,
+						},
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[PASS] QMK directory is a git repo with initialized submodules",
+						fmt.Sprintf("[PASS] code file directory %s is writable", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						fmt.Sprintf("[PASS] code file %s contains codes from a running build (PID 5678)", filepath.Join(qmkDir, codeFile)),
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[PASS] make target test:leep_frog exists",
+						"",
+					}, "\n"),
+				}
+			},
+		},
+		{
+			name:  "fails if submodules aren't initialized",
+			setup: healthyQMKDir(scrubbed),
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Stdout: []string{
+							"-abc123 lib/chibios",
+							"-def456 lib/lufa",
+						}},
+						{},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "git",
+							Args: []string{"submodule", "status"},
+							Dir:  qmkDir,
+						},
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[FAIL] submodules aren't initialized: lib/chibios, lib/lufa",
+						"       Run `qmk git-submodule` in the QMK directory",
+						fmt.Sprintf("[PASS] code file directory %s is writable", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						fmt.Sprintf("[PASS] code file %s is scrubbed", filepath.Join(qmkDir, codeFile)),
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[PASS] make target test:leep_frog exists",
+						"",
+					}, "\n"),
+					WantStderr: "1 doctor check(s) failed\n",
+					WantErr:    fmt.Errorf("1 doctor check(s) failed"),
+				}
+			},
+		},
+		{
+			name:      "fails for missing executables and directories",
+			notOnPath: []string{"qmk"},
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					RunResponses: []*commandtest.FakeRun{
+						{Err: fmt.Errorf("no rule")},
+					},
+					WantRunContents: []*commandtest.RunContents{
+						{
+							Name: "make",
+							Args: []string{"-n", testTarget},
+							Dir:  qmkDir,
+						},
+					},
+					WantStdout: strings.Join([]string{
+						"[FAIL] qmk is not on PATH",
+						"       Install the QMK CLI (https://docs.qmk.fm/newbs_getting_started)",
+						"[PASS] git is on PATH",
+						fmt.Sprintf("[FAIL] QMK directory %s is not a git repo", qmkDir),
+						"       Clone QMK with `qmk setup` (or `git clone`) and update the directory with `q config set`",
+						fmt.Sprintf("[FAIL] code file directory %s doesn't exist", filepath.Dir(filepath.Join(qmkDir, codeFile))),
+						"       Create it or update the userspace and code file with `q config set`",
+						fmt.Sprintf("[PASS] code file %s doesn't exist (it is created by the next build)", filepath.Join(qmkDir, codeFile)),
+						fmt.Sprintf("[PASS] output directory %s is writable", outputDir),
+						"[FAIL] make target test:leep_frog doesn't exist",
+						fmt.Sprintf("       Add the tests to %s", filepath.Join(qmkDir, userspaceDir)),
+						"",
+					}, "\n"),
+					WantStderr: "4 doctor check(s) failed\n",
+					WantErr:    fmt.Errorf("4 doctor check(s) failed"),
+				}
+			},
+		},
+		{
+			name:   "fails if directories aren't set",
+			noDirs: true,
+			etc: func(qmkDir, outputDir string) *commandtest.ExecuteTestCase {
+				return &commandtest.ExecuteTestCase{
+					Args: []string{"doctor"},
+					WantStdout: strings.Join([]string{
+						"[PASS] qmk is on PATH",
+						"[PASS] git is on PATH",
+						"[FAIL] directory values have not been set",
+						"       Run `q config set`",
+						"",
+					}, "\n"),
+					WantStderr: "1 doctor check(s) failed\n",
+					WantErr:    fmt.Errorf("1 doctor check(s) failed"),
+				}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			commandtest.StubValue(t, &execLookPath, func(name string) (string, error) {
+				for _, n := range test.notOnPath {
+					if n == name {
+						return "", fmt.Errorf("not found")
+					}
+				}
+				return filepath.Join("bin", name), nil
+			})
+			commandtest.StubValue(t, &processRunning, func(pid int) bool { return pid == 5678 })
+
+			qmkDir, outputDir := t.TempDir(), t.TempDir()
+			if test.setup != nil {
+				test.setup(t, qmkDir)
+			}
+			qw := &qmkWrapper{}
+			if !test.noDirs {
+				qw.QMKDir, qw.OutputDir = qmkDir, outputDir
+			}
+
+			etc := test.etc(qmkDir, outputDir)
+			etc.Node = qw.Node()
+			commandertest.ExecuteTest(t, etc)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commander"
+)
+
+const (
+	// flasherFileArg is replaced with the artifact path in a Flasher's args.
+	flasherFileArg = "{file}"
+	// defaultBootloader is the flasher used when no bootloader is specified.
+	defaultBootloader = "qmk"
+)
+
+var (
+	// Flashers used when no flasher is configured for a bootloader.
+	defaultFlashers = map[string]*Flasher{
+		defaultBootloader: {
+			CommandName: "qmk",
+			Args:        []string{"flash", flasherFileArg},
+			Extensions:  []string{"hex", "bin", "uf2"},
+		},
+		"caterina": {
+			CommandName: "avrdude",
+			Args:        []string{"-p", "atmega32u4", "-c", "avr109", "-P", "/dev/ttyACM0", "-U", fmt.Sprintf("flash:w:%s:i", flasherFileArg)},
+			Extensions:  []string{"hex"},
+		},
+		"stm32-dfu": {
+			CommandName: "dfu-util",
+			Args:        []string{"-a", "0", "-d", "0483:df11", "-s", "0x08000000:leave", "-D", flasherFileArg},
+			Extensions:  []string{"bin"},
+		},
+	}
+)
+
+// Flasher is a command that flashes a firmware artifact onto a keyboard.
+type Flasher struct {
+	// CommandName is the executable to run.
+	CommandName string
+	// Args are the arguments passed to the executable. Any occurrence of
+	// `{file}` is replaced with the path to the artifact.
+	Args []string
+	// Extensions are the artifact types this flasher supports. If empty,
+	// all artifact types are allowed.
+	Extensions []string
+}
+
+func (f *Flasher) supports(ext string) bool {
+	if len(f.Extensions) == 0 {
+		return true
+	}
+	for _, e := range f.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Flasher) String() string {
+	return strings.Join(append([]string{f.CommandName}, f.Args...), " ")
+}
+
+// flasher returns the flasher for the provided bootloader, preferring
+// user-configured flashers over the defaults.
+func (qw *qmkWrapper) flasher(bootloader, ext string) (*Flasher, error) {
+	f, ok := qw.Flashers[bootloader]
+	if !ok {
+		f, ok = defaultFlashers[bootloader]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no flasher configured for bootloader %q (`q config flasher`)", bootloader)
+	}
+	if !f.supports(ext) {
+		return nil, fmt.Errorf("flasher for bootloader %q does not support %q artifacts", bootloader, ext)
+	}
+	return f, nil
+}
+
+// flash flashes the provided artifact onto the keyboard. uf2 artifacts are
+// copied to the UF2 drive if a deploy directory is set.
+func (qw *qmkWrapper) flash(o command.Output, d *command.Data, file string) error {
+	ext := artifactExt(file)
+	if dir := qw.deployDir(d); dir != "" && ext == "uf2" {
+		return qw.deploy(o, file, dir)
+	} else if deployDirFlag.Provided(d) {
+		return o.Err(fmt.Errorf("only uf2 artifacts can be copied to a UF2 drive (got %s)", file))
+	}
+
+	bootloader := defaultBootloader
+	if bootloaderFlag.Provided(d) {
+		bootloader = bootloaderFlag.Get(d)
+	}
+
+	f, err := qw.flasher(bootloader, ext)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	var args []string
+	for _, a := range f.Args {
+		args = append(args, strings.ReplaceAll(a, flasherFileArg, file))
+	}
+
+	sc := &commander.ShellCommand[string]{
+		CommandName:   f.CommandName,
+		Args:          args,
+		ForwardStdout: true,
+	}
+	if _, err := sc.Run(o, d); err != nil {
+		return o.Annotatef(err, "failed to flash %s", file)
+	}
+	o.Stdoutf("Successfully flashed %s\n", file)
+	return nil
+}
+
+func (qw *qmkWrapper) listFlashers(o command.Output) {
+	if len(qw.Flashers) == 0 {
+		return
+	}
+	var bootloaders []string
+	for b := range qw.Flashers {
+		bootloaders = append(bootloaders, b)
+	}
+	sort.Strings(bootloaders)
+	o.Stdoutln("Flashers:")
+	for _, b := range bootloaders {
+		o.Stdoutf("  %s: %s\n", b, qw.Flashers[b])
+	}
+}
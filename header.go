@@ -0,0 +1,144 @@
+package qmkwrapper
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultHeaderTemplate generates the code file when no header template
+	// is configured.
+	defaultHeaderTemplate = `#pragma once
+#define LEEP_VERSION {{ printf "%q" .Version }}
+{{- if .Describe }}
+#define LEEP_GIT_DESCRIBE {{ printf "%q" .Describe }}
+#define LEEP_DIRTY {{ if .Dirty }}1{{ else }}0{{ end }}
+{{- end }}
+{{- if .Branch }}
+#define LEEP_GIT_BRANCH {{ printf "%q" .Branch }}
+{{- end }}
+{{- if .UserspaceCommit }}
+#define LEEP_USERSPACE_COMMIT {{ printf "%q" .UserspaceCommit }}
+{{- end }}
+{{- if .Cipher }}
+#define LEEP_CIPHER {{ printf "%q" .Cipher }}
+{{- end }}
+{{- range .Codes }}
+#define {{ .Define }} {{ printf "%q" .Value }}
+{{- end }}
+`
+)
+
+var (
+	headerTemplateFuncs = template.FuncMap{
+		"upper": strings.ToUpper,
+	}
+)
+
+// HeaderCode is a code written to the code file.
+type HeaderCode struct {
+	// Name is the name of the code slot.
+	Name string
+	// Define is the name of the define for the code (LEEP_CODE_<NAME>).
+	Define string
+	// Value is the (possibly encoded) code.
+	Value string
+}
+
+// HeaderData is the data passed to the header template.
+type HeaderData struct {
+	// Version is the value of LEEP_VERSION. Header templates must define
+	// LEEP_VERSION so codes left behind by an interrupted build can be detected.
+	Version string
+	// Commit is the full commit of the QMK repo.
+	Commit string
+	// Describe is the output of `git describe --always` for the QMK repo.
+	Describe string
+	// Branch is the checked out branch of the QMK repo (empty if detached).
+	Branch string
+	// UserspaceCommit is the full commit of the userspace (empty if the
+	// userspace isn't a separate repo).
+	UserspaceCommit string
+	// Dirty is whether the QMK repo or the userspace has uncommitted changes.
+	Dirty bool
+	// Timestamp is the time of the build (zero for a code file with no codes).
+	Timestamp time.Time
+	// Keyboard and Keymap are empty when the code file is shared by
+	// multiple targets (`q batch`).
+	Keyboard string
+	Keymap   string
+	// Cipher is the name of the cipher the codes were encoded with (empty if
+	// the codes aren't encoded).
+	Cipher string
+	Codes  []*HeaderCode
+}
+
+// Code returns the value of the code for the slot.
+func (hd *HeaderData) Code(name string) string {
+	for _, c := range hd.Codes {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// headerData returns the header data for the slots and codes.
+func (qw *qmkWrapper) headerData(version string, codes map[string]string) *HeaderData {
+	hd := &HeaderData{
+		Version: version,
+	}
+	for _, cs := range qw.codeSlots() {
+		hd.Codes = append(hd.Codes, &HeaderCode{
+			Name:   cs.Name,
+			Define: cs.define(),
+			Value:  codes[cs.Name],
+		})
+	}
+	return hd
+}
+
+// codeFileContents returns the contents of the code file generated by the
+// configured header template.
+func (qw *qmkWrapper) codeFileContents(hd *HeaderData) ([]byte, error) {
+	if qw.HeaderTemplate == "" {
+		return executeHeaderTemplate(defaultHeaderTemplate, hd)
+	}
+	b, err := osReadFile(qw.HeaderTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header template: %v", err)
+	}
+	return executeHeaderTemplate(string(b), hd)
+}
+
+func executeHeaderTemplate(text string, hd *HeaderData) ([]byte, error) {
+	t, err := template.New("header").Funcs(headerTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse header template: %v", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, hd); err != nil {
+		return nil, fmt.Errorf("failed to execute header template: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// validateHeaderTemplate checks that the template generates a code file with
+// a LEEP_VERSION define.
+func (qw *qmkWrapper) validateHeaderTemplate(f string) error {
+	b, err := osReadFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to read header template: %v", err)
+	}
+	contents, err := executeHeaderTemplate(string(b), qw.headerData(scrubbedVersion, nil))
+	if err != nil {
+		return err
+	}
+	if !leepVersionRegex.Match(contents) {
+		return fmt.Errorf("header template must define LEEP_VERSION (used to detect leftover codes)")
+	}
+	return nil
+}
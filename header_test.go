@@ -0,0 +1,165 @@
+package qmkwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCodeFileContents(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		template string
+		slots    []*CodeSlot
+		hd       func(qw *qmkWrapper) *HeaderData
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "default template with no codes",
+			hd: func(qw *qmkWrapper) *HeaderData {
+				return qw.headerData(scrubbedVersion, nil)
+			},
+			want: strings.Join([]string{
+				"#pragma once",
+				`#define LEEP_VERSION "auto-generated"`,
+				`#define LEEP_CODE_1 ""`,
+				`#define LEEP_CODE_2 ""`,
+				"",
+			}, "\n"),
+		},
+		{
+			name:  "default template with cipher and named slots",
+			slots: append(defaultSlots("", ""), &CodeSlot{Name: "work"}),
+			hd: func(qw *qmkWrapper) *HeaderData {
+				hd := qw.headerData("2001-02-03 04:05:06 abc123", map[string]string{
+					"1":    "one",
+					"work": `w"rk`,
+				})
+				hd.Cipher = "rot"
+				return hd
+			},
+			want: strings.Join([]string{
+				"#pragma once",
+				`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+				`#define LEEP_CIPHER "rot"`,
+				`#define LEEP_CODE_1 "one"`,
+				`#define LEEP_CODE_2 ""`,
+				`#define LEEP_CODE_WORK "w\"rk"`,
+				"",
+			}, "\n"),
+		},
+		{
+			name:     "custom template",
+			template: filepath.Join("testdata", "header.tmpl"),
+			hd: func(qw *qmkWrapper) *HeaderData {
+				hd := qw.headerData("2001-02-03 04:05:06 abc123", map[string]string{
+					"1": "one",
+				})
+				hd.Commit = "abc123def456"
+				hd.Timestamp = time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+				hd.Keyboard = "kb/subkb"
+				hd.Keymap = "km"
+				return hd
+			},
+			want: strings.Join([]string{
+				"#pragma once",
+				`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+				`#define LEEP_KEYBOARD "kb/subkb"`,
+				`#define LEEP_BUILD_ID "KB/SUBKB-abc123def456"`,
+				`#define LEEP_CODE_1 "one"`,
+				`#define LEEP_CODE_2 ""`,
+				`#define LEEP_HAS_CODE_1`,
+				"",
+			}, "\n"),
+		},
+		{
+			name:     "custom template with no codes",
+			template: filepath.Join("testdata", "header.tmpl"),
+			hd: func(qw *qmkWrapper) *HeaderData {
+				return qw.headerData(scrubbedVersion, nil)
+			},
+			want: strings.Join([]string{
+				"#pragma once",
+				`#define LEEP_VERSION "auto-generated"`,
+				`#define LEEP_CODE_1 ""`,
+				`#define LEEP_CODE_2 ""`,
+				"",
+			}, "\n"),
+		},
+		{
+			name:     "missing template",
+			template: filepath.Join("testdata", "missing.tmpl"),
+			hd: func(qw *qmkWrapper) *HeaderData {
+				return qw.headerData(scrubbedVersion, nil)
+			},
+			wantErr: "failed to read header template: open testdata/missing.tmpl: no such file or directory",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			qw := &qmkWrapper{
+				HeaderTemplate: test.template,
+				slots:          test.slots,
+			}
+			got, err := qw.codeFileContents(test.hd(qw))
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Errorf("codeFileContents() returned wrong error (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("codeFileContents() returned wrong contents (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateHeaderTemplate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{
+			name:     "valid template",
+			template: defaultHeaderTemplate,
+		},
+		{
+			name:     "template without LEEP_VERSION",
+			template: "#pragma once\n#define LEEP_CODE_1 {{ printf \"%q\" (.Code \"1\") }}\n",
+			wantErr:  "header template must define LEEP_VERSION (used to detect leftover codes)",
+		},
+		{
+			name:     "unparseable template",
+			template: "{{ .Version ",
+			wantErr:  `failed to parse header template: template: header:1: unclosed action`,
+		},
+		{
+			name:     "template that fails to execute",
+			template: "{{ .Unknown }}",
+			wantErr:  `failed to execute header template: template: header:1:3: executing "header" at <.Unknown>: can't evaluate field Unknown in type *qmkwrapper.HeaderData`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "header.tmpl")
+			if err := os.WriteFile(f, []byte(test.template), 0644); err != nil {
+				t.Fatalf("failed to write template: %v", err)
+			}
+			qw := &qmkWrapper{}
+			err := qw.validateHeaderTemplate(f)
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Errorf("validateHeaderTemplate() returned wrong error (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
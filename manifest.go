@@ -0,0 +1,51 @@
+package qmkwrapper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	manifestSuffix = ".manifest.json"
+)
+
+// Manifest records how an artifact was built.
+type Manifest struct {
+	Keyboard  string    `json:"keyboard"`
+	Keymap    string    `json:"keymap"`
+	Commit    string    `json:"commit"`
+	Timestamp time.Time `json:"timestamp"`
+	Artifact  string    `json:"artifact"`
+	Hashed    bool      `json:"hashed"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"`
+}
+
+func newManifest(kb, km, commit, ext string, hashed bool, data []byte) *Manifest {
+	sum := sha256.Sum256(data)
+	return &Manifest{
+		Keyboard:  kb,
+		Keymap:    km,
+		Commit:    commit,
+		Timestamp: timeNow(),
+		Artifact:  ext,
+		Hashed:    hashed,
+		Size:      len(data),
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+}
+
+// writeManifest writes the manifest next to the provided artifact.
+func writeManifest(artifact string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	if err := osWriteFile(artifact+manifestSuffix, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
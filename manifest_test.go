@@ -0,0 +1,70 @@
+package qmkwrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/commandtest"
+)
+
+// manifestData returns the expected manifest file contents for an artifact
+// built in TestMain.
+func manifestData(t *testing.T, kb, km, commit, ext string, hashed bool, contents string) string {
+	t.Helper()
+	m := newManifest(kb, km, commit, ext, hashed, []byte(contents))
+	// TestMain cases are constructed before timeNow is stubbed.
+	m.Timestamp = time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	return string(b) + "\n"
+}
+
+func TestManifest(t *testing.T) {
+	commandtest.StubValue(t, &timeNow, func() time.Time {
+		return time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	})
+
+	var gotFile, gotData string
+	commandtest.StubValue(t, &osWriteFile, func(s string, data []byte, _ os.FileMode) error {
+		gotFile, gotData = s, string(data)
+		return nil
+	})
+
+	if err := writeManifest("kb_km.bin", newManifest("kb", "km", "abc123def456", "bin", true, []byte("abcd"))); err != nil {
+		t.Fatalf("writeManifest() returned error: %v", err)
+	}
+
+	if diff := cmp.Diff("kb_km.bin.manifest.json", gotFile); diff != "" {
+		t.Errorf("writeManifest() wrote to wrong file (-want, +got):\n%s", diff)
+	}
+	want := strings.Join([]string{
+		"{",
+		`  "keyboard": "kb",`,
+		`  "keymap": "km",`,
+		`  "commit": "abc123def456",`,
+		`  "timestamp": "2001-02-03T04:05:06.000000007Z",`,
+		`  "artifact": "bin",`,
+		`  "hashed": true,`,
+		`  "size": 4,`,
+		`  "sha256": "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589"`,
+		"}",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(want, gotData); diff != "" {
+		t.Errorf("writeManifest() wrote wrong contents (-want, +got):\n%s", diff)
+	}
+
+	commandtest.StubValue(t, &osWriteFile, func(string, []byte, os.FileMode) error {
+		return fmt.Errorf("oops")
+	})
+	if err := writeManifest("kb_km.bin", newManifest("kb", "km", "abc123def456", "bin", true, []byte("abcd"))); err == nil || err.Error() != "failed to write manifest: oops" {
+		t.Errorf("writeManifest() returned wrong error: %v", err)
+	}
+}
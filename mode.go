@@ -0,0 +1,78 @@
+package qmkwrapper
+
+import (
+	"fmt"
+)
+
+const (
+	// basicMode is the mode for regular keyboards (C-h deletes a character).
+	basicMode = "basic"
+	// qmkMode is the mode for QMK keyboards, which send C-h to delete a word.
+	qmkMode = "qmk"
+)
+
+var (
+	// Key bindings for each mode (bash and zsh).
+	modeBindings = map[string]*keyBindings{
+		basicMode: {
+			bash: basicKeyboardBindings,
+			zsh:  basicZshKeyboardBindings,
+		},
+		qmkMode: {
+			bash: qmkKeyboardBindings,
+			zsh:  qmkZshKeyboardBindings,
+		},
+	}
+)
+
+type keyBindings struct {
+	bash []string
+	zsh  []string
+}
+
+// shellLines returns the lines that apply the bindings in the current shell.
+func (kb *keyBindings) shellLines() []string {
+	r := []string{`if [ -n "$ZSH_VERSION" ]; then`}
+	for _, b := range kb.zsh {
+		r = append(r, "  "+b)
+	}
+	r = append(r, "else")
+	for _, b := range kb.bash {
+		r = append(r, "  "+b)
+	}
+	return append(r, "fi")
+}
+
+func validateMode(mode string) error {
+	if _, ok := modeBindings[mode]; !ok {
+		return fmt.Errorf("unknown mode %q (must be one of [%s, %s])", mode, basicMode, qmkMode)
+	}
+	return nil
+}
+
+// mode returns the mode set with `q mode`.
+func (qw *qmkWrapper) mode() string {
+	if qw.Mode != "" {
+		return qw.Mode
+	}
+	return basicMode
+}
+
+// setMode saves the mode (so new shells use it too) and returns the shell
+// lines that apply it in the current shell.
+func (qw *qmkWrapper) setMode(mode string) ([]string, error) {
+	if err := validateMode(mode); err != nil {
+		return nil, err
+	}
+	if qw.Mode != mode {
+		qw.Mode = mode
+		qw.changed = true
+	}
+	return modeLines(mode), nil
+}
+
+// modeLines returns the shell lines that store the mode in QMKEnvArg and apply
+// its key bindings.
+func modeLines(mode string) []string {
+	return append([]string{fmt.Sprintf("export %s=%s", QMKEnvArg, mode)}, modeBindings[mode].shellLines()...)
+}
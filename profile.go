@@ -0,0 +1,221 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// defaultProfileName is the name of the profile stored in the top-level
+	// config fields (so configs from before profiles existed keep working).
+	defaultProfileName = "default"
+)
+
+// Profile is a QMK checkout (e.g. upstream qmk_firmware or a fork) and the
+// settings used to build from it.
+type Profile struct {
+	QMKDir    string
+	OutputDir string
+	// Userspace is the name of the QMK userspace (defaults to leep-frog).
+	Userspace string
+	// CodeFile is the path to the code file relative to QMKDir (defaults to
+	// v2/leep_codes_v2.h in the userspace).
+	CodeFile string
+	// Artifact is the artifact type built when `--hex-file` isn't provided
+	// (defaults to the artifact discovered after the build).
+	Artifact string
+	// DeployDir is the directory uf2 artifacts are copied to when flashing
+	// (see `--deploy-dir`).
+	DeployDir string
+	Shortcuts map[string]map[string][]string
+}
+
+// profileName returns the name of the profile in use (the `--profile` flag,
+// then the active profile, then the default profile).
+func (qw *qmkWrapper) profileName() string {
+	if qw.profileOverride != "" {
+		return qw.profileOverride
+	}
+	if qw.ActiveProfile != "" {
+		return qw.ActiveProfile
+	}
+	return defaultProfileName
+}
+
+// profile returns the profile in use. The default profile is a copy of the
+// top-level fields, so changes must be made with updateProfile.
+func (qw *qmkWrapper) profile() *Profile {
+	name := qw.profileName()
+	if name == defaultProfileName {
+		return &Profile{
+			QMKDir:    qw.QMKDir,
+			OutputDir: qw.OutputDir,
+			Userspace: qw.Userspace,
+			CodeFile:  qw.CodeFile,
+			Artifact:  qw.Artifact,
+			DeployDir: qw.DeployDir,
+			Shortcuts: qw.Shortcuts,
+		}
+	}
+	if p, ok := qw.Profiles[name]; ok {
+		return p
+	}
+	return &Profile{}
+}
+
+// updateProfile applies f to the profile in use.
+func (qw *qmkWrapper) updateProfile(f func(p *Profile)) {
+	p := qw.profile()
+	f(p)
+	if qw.profileName() == defaultProfileName {
+		qw.QMKDir = p.QMKDir
+		qw.OutputDir = p.OutputDir
+		qw.Userspace = p.Userspace
+		qw.CodeFile = p.CodeFile
+		qw.Artifact = p.Artifact
+		qw.DeployDir = p.DeployDir
+		qw.Shortcuts = p.Shortcuts
+	}
+	qw.changed = true
+}
+
+// selectProfile uses the profile provided with `--profile` (if any).
+func (qw *qmkWrapper) selectProfile(d *command.Data) error {
+	if !profileFlag.Provided(d) {
+		return nil
+	}
+	if err := qw.checkProfile(profileFlag.Get(d)); err != nil {
+		return err
+	}
+	qw.profileOverride = profileFlag.Get(d)
+	return nil
+}
+
+func (qw *qmkWrapper) checkProfile(name string) error {
+	if _, ok := qw.Profiles[name]; !ok && name != defaultProfileName {
+		return fmt.Errorf("unknown profile %q (`q config profile add`)", name)
+	}
+	return nil
+}
+
+// artifactType returns the artifact type to build (hex if `--hex-file` is
+// provided, then the `--artifact` flag, then the profile's artifact type).
+func (qw *qmkWrapper) artifactType(d *command.Data) string {
+	if ext := hexFileFlag.Get(d); ext != "bin" {
+		return ext
+	}
+	if artifactFlag.Provided(d) {
+		return artifactFlag.Get(d)
+	}
+	if a := qw.profile().Artifact; a != "" {
+		return a
+	}
+	return "bin"
+}
+
+// profileSettings returns a copy of p with the directories from the args and
+// the settings from the flags (settings whose flags aren't provided are kept).
+func profileSettings(d *command.Data, p *Profile) (*Profile, error) {
+	np := *p
+	np.QMKDir = qmkDirArg.Get(d)
+	np.OutputDir = outputDirArg.Get(d)
+	if userspaceFlag.Provided(d) {
+		np.Userspace = userspaceFlag.Get(d)
+		if err := validateUserspace(np.Userspace); err != nil {
+			return nil, err
+		}
+	}
+	if codeFileFlag.Provided(d) {
+		var err error
+		if np.CodeFile, err = relativeCodeFile(np.QMKDir, codeFileFlag.Get(d)); err != nil {
+			return nil, err
+		}
+	}
+	if artifactFlag.Provided(d) {
+		np.Artifact = artifactFlag.Get(d)
+		if err := validateArtifact(np.Artifact); err != nil {
+			return nil, err
+		}
+	}
+	if deployDirFlag.Provided(d) {
+		dir, err := filepath.Abs(deployDirFlag.Get(d))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path for deploy directory: %v", err)
+		}
+		np.DeployDir = dir
+	}
+	return &np, nil
+}
+
+func validateArtifact(a string) error {
+	if !artifactExts["."+a] {
+		return fmt.Errorf("invalid artifact type %q (must be one of [bin, hex, uf2])", a)
+	}
+	return nil
+}
+
+func (qw *qmkWrapper) addProfile(name string, p *Profile) error {
+	if err := qw.checkProfile(name); err == nil {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+	if qw.Profiles == nil {
+		qw.Profiles = map[string]*Profile{}
+	}
+	qw.Profiles[name] = p
+	qw.changed = true
+	return nil
+}
+
+func (qw *qmkWrapper) removeProfile(name string) error {
+	if name == defaultProfileName {
+		return fmt.Errorf("the default profile can't be removed")
+	}
+	if err := qw.checkProfile(name); err != nil {
+		return err
+	}
+	if qw.ActiveProfile == name {
+		return fmt.Errorf("profile %q is active (`q config use %s` first)", name, defaultProfileName)
+	}
+	delete(qw.Profiles, name)
+	qw.changed = true
+	return nil
+}
+
+func (qw *qmkWrapper) useProfile(name string) error {
+	if err := qw.checkProfile(name); err != nil {
+		return err
+	}
+	if name == defaultProfileName {
+		name = ""
+	}
+	qw.ActiveProfile = name
+	qw.changed = true
+	return nil
+}
+
+// listProfiles prints all profiles with the one in use marked by an asterisk.
+func (qw *qmkWrapper) listProfiles(o command.Output) {
+	if len(qw.Profiles) == 0 {
+		return
+	}
+	names := []string{defaultProfileName}
+	for n := range qw.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names[1:])
+	o.Stdoutln("Profiles:")
+	for _, n := range names {
+		marker := " "
+		if n == qw.profileName() {
+			marker = "*"
+		}
+		qmkDir, outputDir := qw.QMKDir, qw.OutputDir
+		if p, ok := qw.Profiles[n]; ok {
+			qmkDir, outputDir = p.QMKDir, p.OutputDir
+		}
+		o.Stdoutf("%s %s: %s -> %s\n", marker, n, qmkDir, outputDir)
+	}
+}
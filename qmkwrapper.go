@@ -1,11 +1,13 @@
 package qmkwrapper
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/leep-frog/command/command"
@@ -14,8 +16,13 @@ import (
 )
 
 const (
-	// TODO: Use this to replace old qmk CLI.
+	// QMKEnvArg is the environment variable the keyboard mode is exported to
+	// (see `q mode`).
 	QMKEnvArg = "LEEP_QMK"
+
+	// Names of the keyboard and keymap args (see Node).
+	keyboardArgName = "KEYBOARD"
+	keymapArgName   = "KEYMAP"
 )
 
 var (
@@ -25,26 +32,51 @@ var (
 
 var (
 	shortcutName = "compile-shortcut"
-	codeFile     = filepath.Join("users", "leep-frog", "v2", "leep_codes_v2.h")
+	// Default userspace and code file (see `q config set`)
+	userspaceDir = filepath.Join("users", "leep-frog")
+	codeFileName = filepath.Join("v2", "leep_codes_v2.h")
 	slashRegbex  = regexp.MustCompile(`[\\/]`)
 	// methods that are stubbed in tests
 	osReadFile  = os.ReadFile
 	osWriteFile = os.WriteFile
 
-	// TODO: Actualy use these binding things to replace the old qmk CLI.
+	// Key bindings for each keyboard mode (see `q mode`).
 	basicKeyboardBindings = []string{
 		`bind '"\C-h":backward-delete-char'`,
 	}
 	qmkKeyboardBindings = []string{
 		`bind '"\C-h":backward-kill-word'`,
 	}
+	basicZshKeyboardBindings = []string{
+		`bindkey '^H' backward-delete-char`,
+	}
+	qmkZshKeyboardBindings = []string{
+		`bindkey '^H' backward-kill-word`,
+	}
 )
 
-func CLI(code1, code2 string) sourcerer.CLI {
-	return &qmkWrapper{
-		hash:  code1,
-		hash2: code2,
+// CLI returns the q CLI. code1 and code2 are the hash keys for the
+// LEEP_CODE_1 and LEEP_CODE_2 codes; additional codes can be added with slots.
+func CLI(code1, code2 string, slots ...*CodeSlot) sourcerer.CLI {
+	qw := &qmkWrapper{
+		slots: append(defaultSlots(code1, code2), slots...),
 	}
+	// Slots are fixed at compile time, so an invalid one is a programming error.
+	// Slot names are upper-cased in defines, so they must be unique ignoring case.
+	seen := map[string]string{}
+	for _, cs := range qw.slots {
+		if !slotNameRegex.MatchString(cs.Name) {
+			panic(fmt.Sprintf("invalid code slot name %q (must match %s)", cs.Name, slotNameRegex))
+		}
+		if prev, ok := seen[strings.ToUpper(cs.Name)]; ok {
+			if prev == cs.Name {
+				panic(fmt.Sprintf("code slot %q registered more than once", cs.Name))
+			}
+			panic(fmt.Sprintf("code slots %q and %q both define %s", prev, cs.Name, cs.define()))
+		}
+		seen[strings.ToUpper(cs.Name)] = cs.Name
+	}
+	return qw
 }
 
 func Aliasers() sourcerer.Option {
@@ -59,16 +91,6 @@ func Aliasers() sourcerer.Option {
 	})
 }
 
-func codeFileContents(version, code1, code2 string) []byte {
-	return []byte(strings.Join([]string{
-		"#pragma once",
-		fmt.Sprintf("#define LEEP_VERSION %q", version),
-		fmt.Sprintf("#define LEEP_CODE_1 %q", code1),
-		fmt.Sprintf("#define LEEP_CODE_2 %q", code2),
-		"",
-	}, "\n"))
-}
-
 const (
 	minRune           = 32
 	maxRune           = 126
@@ -76,22 +98,30 @@ const (
 )
 
 func rot(hash, key string, pos bool) string {
-	if len(key) == 0 {
+	return rotN(hash, key, pos, normalizedMaxRune)
+}
+
+// rotN rotates hash by key within an alphabet of n characters starting at
+// minRune. Characters outside of the alphabet produce garbage, so inputs
+// should be checked with rotCipher.Validate first.
+func rotN(hash, key string, pos bool, n rune) string {
+	keyRunes := []rune(key)
+	if len(keyRunes) == 0 {
 		return ""
 	}
 	var r []string
 	// offset start at min char (rune 0?)
-	for i, c := range hash {
-		k := rune(key[i%len(key)])
+	for i, c := range []rune(hash) {
+		k := keyRunes[i%len(keyRunes)]
 		// normalized c and k
 		nc := c - minRune
 		nk := k - minRune
 
 		var nv rune
 		if pos {
-			nv = (nc + nk) % (normalizedMaxRune)
+			nv = (nc + nk) % n
 		} else {
-			nv = (nc + normalizedMaxRune - nk) % (normalizedMaxRune)
+			nv = (nc + n - nk) % n
 		}
 
 		// regular v
@@ -104,11 +134,46 @@ func rot(hash, key string, pos bool) string {
 type qmkWrapper struct {
 	QMKDir    string
 	OutputDir string
+	// Userspace is the name of the QMK userspace (defaults to leep-frog).
+	Userspace string
+	// CodeFile is the path to the code file relative to QMKDir (defaults to
+	// v2/leep_codes_v2.h in the userspace).
+	CodeFile string
+	// Artifact is the artifact type built when `--hex-file` isn't provided
+	// (defaults to the artifact discovered after the build).
+	Artifact string
+	// DeployDir is the directory uf2 artifacts are copied to when flashing
+	// (see `--deploy-dir`).
+	DeployDir string
 	Shortcuts map[string]map[string][]string
-
-	hash    string
-	hash2   string
-	changed bool
+	// Profiles are additional QMK checkouts. The fields above are the
+	// default profile.
+	Profiles map[string]*Profile
+	// ActiveProfile is the name of the profile used when `--profile` isn't
+	// provided (empty for the default profile).
+	ActiveProfile string
+	Flashers      map[string]*Flasher
+	// SizeBudgets are the firmware size limits for each keyboard.
+	SizeBudgets map[string]*SizeBudget
+	Cipher      string
+	Secrets     map[string]*SecretSource
+	Vault       *Vault
+	// HeaderTemplate is the path to the text/template used to generate the
+	// code file (see HeaderData).
+	HeaderTemplate string
+	// Mode is the keyboard mode set with `q mode` (defaults to basic).
+	Mode string
+
+	// slots are the codes written to the code file (see CLI).
+	slots []*CodeSlot
+	// profileOverride is the profile provided with `--profile`.
+	profileOverride string
+	// forceReproducible is set by `q verify-reproducible`.
+	forceReproducible bool
+	// keepLeftoverCodes is set by `q doctor` so leftover codes are reported
+	// instead of removed.
+	keepLeftoverCodes bool
+	changed           bool
 }
 
 func (qw *qmkWrapper) Name() string {
@@ -119,30 +184,83 @@ func (qw *qmkWrapper) Changed() bool {
 	return qw.changed
 }
 
+// Setup applies the key bindings for the keyboard mode set with `q mode`.
 func (qw *qmkWrapper) Setup() []string {
-	return nil
+	m := qw.mode()
+	if validateMode(m) != nil {
+		m = basicMode
+	}
+	return modeLines(m)
 }
 
 var (
 	// Compile args
-	keyboardArg = commander.Arg[string]("KEYBOARD", "Keyboard")
-	keymapArg   = commander.Arg[string]("KEYMAP", "Keymap")
-	hexFileFlag = commander.BoolValuesFlag("hex-file", 'x', "If the suffix is a hex file", "hex", "bin")
-	hashFlag    = commander.BoolFlag("hash", 'h', "Whether code1 and code2 should be hashed")
-	codesFlag   = commander.ListFlag[string]("codes", 'c', "Codes for fixed code keys", 2, 0)
+	hexFileFlag      = commander.BoolValuesFlag("hex-file", 'x', "Whether to copy the hex file instead of the discovered artifact", "hex", "bin")
+	hashFlag         = commander.BoolFlag("hash", 'h', "Whether codes should be hashed")
+	codesFlag        = commander.ListFlag[string]("codes", 'c', "Codes for fixed code keys", 2, 0)
+	codeFlag         = commander.ListFlag[string]("code", 'K', "Codes for named code slots (NAME=VALUE)", 1, command.UnboundedList)
+	secretFlag       = commander.ListFlag[string]("secret", 'S', "Secrets to read codes from (SLOT=SECRET_NAME; see `q config secret`)", 1, command.UnboundedList)
+	vaultCodesFlag   = commander.Flag[string]("vault-codes", 'V', "Comma-separated code slots to decrypt from the vault (see `q vault add`)")
+	flashFlag        = commander.BoolFlag("flash", 'f', "Whether the artifact should be flashed after compiling")
+	cipherFlag       = commander.Flag[string]("cipher", 'C', "Cipher used to hash codes (overrides `q config cipher`)")
+	profileFlag      = commander.Flag[string]("profile", 'p', "Profile to build with (overrides `q config use`)")
+	reproducibleFlag = commander.BoolFlag("reproducible", 'r', "Whether to use the commit time instead of the current time so builds of a commit are identical (implied by SOURCE_DATE_EPOCH)")
+	jsonFlag         = commander.BoolFlag("json", 'j', "Whether to print compile diagnostics as JSON (for editor integration)")
+
+	// Flash args
+	bootloaderFlag = commander.Flag[string]("bootloader", 'b', "Bootloader of the keyboard (determines the flasher to use)")
+
+	// Batch args
+	targetsFileArg = commander.FileArgument("TARGETS_FILE", "JSON file containing a list of keyboard/keymap targets")
+	workersFlag    = commander.Flag[int]("workers", 'w', "Number of targets to compile concurrently", commander.Default(4))
+
+	// Artifact args
+	keepFlag      = commander.Flag[int]("keep", 'k', "Number of artifacts to keep for each keyboard/keymap", commander.Default(5))
+	artifactIDArg = commander.Arg[string]("ARTIFACT_ID", "ID of the artifact (from `q artifacts list`)")
+
+	// Codes args
+	codeSlotArg = commander.Arg[string]("CODE_SLOT", "Code slot whose embedded hash key is used")
+
+	// Vault args
+	vaultSlotArg = commander.Arg[string]("CODE_SLOT", "Code slot the vault code is used for")
+
+	// Mode args
+	modeArg = commander.OptionalArg[string]("MODE", "Keyboard mode (basic or qmk)", commander.SimpleCompleter[string](basicMode, qmkMode))
 
 	// Config args
-	qmkDirArg = commander.FileArgument("QMK_DIR", "Root directory of QMK", commander.IsDir(), &commander.FileCompleter[string]{
+	userspaceFlag = commander.Flag[string]("userspace", 'u', "Name of the QMK userspace (users/<NAME>)")
+	codeFileFlag  = commander.Flag[string]("code-file", 'F', "Path to the code file (relative to the QMK directory)")
+	artifactFlag  = commander.Flag[string]("artifact", 'a', "Artifact type (bin, hex, or uf2) to use instead of the discovered artifact")
+	deployDirFlag = commander.Flag[string]("deploy-dir", 'D', "Directory to copy uf2 artifacts to once the UF2 drive appears in it (the drive or its parent, e.g. /media/<user>)")
+	qmkDirArg     = commander.FileArgument("QMK_DIR", "Root directory of QMK", commander.IsDir(), &commander.FileCompleter[string]{
 		IgnoreFiles: true,
 	})
 	outputDirArg = commander.FileArgument("OUTPUT_DIR", "Output directory for qmk compilation artifacts", commander.IsDir(), &commander.FileCompleter[string]{
 		IgnoreFiles: true,
 	})
+	bootloaderArg     = commander.Arg[string]("BOOTLOADER", "Bootloader the flasher is used for")
+	flasherCmdArg     = commander.Arg[string]("COMMAND", "Flasher executable")
+	flasherArgsArg    = commander.ListArg[string]("ARGS", fmt.Sprintf("Flasher arguments (%s is replaced with the artifact path)", flasherFileArg), 0, command.UnboundedList)
+	cipherArg         = commander.Arg[string]("CIPHER", "Cipher used to hash codes")
+	budgetKeyboardArg = commander.Arg[string]("KEYBOARD", "Keyboard the size budget is for")
+	sizeBudgetArg     = commander.Arg[string]("BUDGET", "Largest firmware size in bytes (e.g. 28000) or percent of flash to keep free (e.g. 10%)")
+	templateFileArg   = commander.FileArgument("TEMPLATE_FILE", "Go text/template file used to generate the code file")
+	secretNameArg     = commander.Arg[string]("SECRET_NAME", "Name used to refer to the secret in `--secret`")
+	secretTypeArg     = commander.Arg[string]("TYPE", "Where the secret is read from (env, file, prompt, or command)")
+	secretArgsArg     = commander.ListArg[string]("ARGS", "Environment variable, file path, or command (depending on TYPE)", 0, command.UnboundedList)
+	profileNameArg    = commander.Arg[string]("PROFILE", "Name of the profile")
 )
 
 func (qw *qmkWrapper) MarkChanged() { qw.changed = true }
 
+// ShortcutMap returns the shortcuts of the active profile.
 func (qw *qmkWrapper) ShortcutMap() map[string]map[string][]string {
+	if p, ok := qw.Profiles[qw.profileName()]; ok {
+		if p.Shortcuts == nil {
+			p.Shortcuts = map[string]map[string][]string{}
+		}
+		return p.Shortcuts
+	}
 	if qw.Shortcuts == nil {
 		qw.Shortcuts = map[string]map[string][]string{}
 	}
@@ -150,120 +268,678 @@ func (qw *qmkWrapper) ShortcutMap() map[string]map[string][]string {
 }
 
 func (qw *qmkWrapper) Node() command.Node {
+	// The keyboard and keymap args complete from the QMK directory, so they're
+	// created here and their values are passed to the commands that use them.
+	keyboardArg := commander.Arg[string](keyboardArgName, "Keyboard", commander.CompleterFromFunc(qw.completeKeyboard))
+	keymapArg := commander.Arg[string](keymapArgName, "Keymap", commander.CompleterFromFunc(func(value string, d *command.Data) (*command.Completion, error) {
+		return qw.completeKeymap(keyboardArg.Get(d)), nil
+	}))
+	versionCommand := &commander.ShellCommand[string]{
+		ArgName:     "VERSION",
+		CommandName: "git",
+		Args:        []string{"rev-parse", "HEAD"},
+	}
+	// verifyConfig must come after the flags since `--profile` determines the
+	// directories.
 	verifyConfig := commander.SuperSimpleProcessor(func(i *command.Input, d *command.Data) error {
-		if qw.QMKDir == "" || qw.OutputDir == "" {
+		if err := qw.selectProfile(d); err != nil {
+			return err
+		}
+		p := qw.profile()
+		if p.QMKDir == "" || p.OutputDir == "" {
 			return fmt.Errorf("Directory values have not been set (`q config set`)")
 		}
+		if artifactFlag.Provided(d) {
+			if err := validateArtifact(artifactFlag.Get(d)); err != nil {
+				return err
+			}
+		}
+		// Flashing prints to stdout, which must only contain the JSON report.
+		if jsonFlag.Get(d) && (flashFlag.Get(d) || deployDirFlag.Provided(d)) {
+			return fmt.Errorf("--json can't be used with --flash or --deploy-dir")
+		}
+		versionCommand.Dir = p.QMKDir
 		return nil
 	})
-	versionCommand := &commander.ShellCommand[string]{
-		ArgName:     "VERSION",
-		CommandName: "git",
-		Args:        []string{"rev-parse", "HEAD"},
-		Dir:         qw.QMKDir,
-	}
-	return &commander.BranchNode{
-		Branches: map[string]command.Node{
-			"test": commander.SerialNodes(
-				commander.SimpleExecutableProcessor("make test:leep_frog"),
-			),
-			"config": &commander.BranchNode{
-				Branches: map[string]command.Node{
-					"list": commander.SerialNodes(
-						&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
-							o.Stdoutf("QMK Directory:    %s\n", qw.QMKDir)
-							o.Stdoutf("Output Directory: %s\n", qw.OutputDir)
-							return nil
-						}},
+	compileFlags := commander.FlagProcessor(
+		hexFileFlag,
+		hashFlag,
+		codesFlag,
+		codeFlag,
+		secretFlag,
+		vaultCodesFlag,
+		cipherFlag,
+		flashFlag,
+		bootloaderFlag,
+		profileFlag,
+		reproducibleFlag,
+		jsonFlag,
+		artifactFlag,
+		deployDirFlag,
+	)
+	return commander.SerialNodes(
+		// Runs before every command in case a previous build was killed before it
+		// could remove its codes.
+		&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+			if qw.keepLeftoverCodes {
+				return nil
+			}
+			return qw.scrubLeftoverCodes(o)
+		}},
+		&commander.BranchNode{
+			Branches: map[string]command.Node{
+				"watch": commander.SerialNodes(
+					compileFlags,
+					verifyConfig,
+					keyboardArg,
+					keymapArg,
+					&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+						return qw.watch(o, d, keyboardArg.Get(d), keymapArg.Get(d), versionCommand)
+					}},
+				),
+				"batch": commander.SerialNodes(
+					commander.FlagProcessor(
+						hexFileFlag,
+						hashFlag,
+						codesFlag,
+						codeFlag,
+						secretFlag,
+						vaultCodesFlag,
+						cipherFlag,
+						workersFlag,
+						profileFlag,
+						reproducibleFlag,
+						artifactFlag,
+					),
+					verifyConfig,
+					targetsFileArg,
+					versionCommand,
+					&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+						return qw.batch(o, d, versionCommand.Get(d))
+					}},
+				),
+				"artifacts": &commander.BranchNode{
+					Branches: map[string]command.Node{
+						"list": commander.SerialNodes(
+							verifyConfig,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.listArtifacts(o)
+							}},
+						),
+						"prune": commander.SerialNodes(
+							verifyConfig,
+							commander.FlagProcessor(
+								keepFlag,
+							),
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.pruneArtifacts(o, keepFlag.Get(d))
+							}},
+						),
+						"restore": commander.SerialNodes(
+							verifyConfig,
+							artifactIDArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.restoreArtifact(o, artifactIDArg.Get(d))
+							}},
+						),
+					},
+				},
+				"codes": &commander.BranchNode{
+					Branches: map[string]command.Node{
+						"encode": commander.SerialNodes(
+							commander.FlagProcessor(
+								cipherFlag,
+							),
+							codeSlotArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.encodeCode(o, d)
+							}},
+						),
+						"decode": commander.SerialNodes(
+							commander.FlagProcessor(
+								cipherFlag,
+							),
+							codeSlotArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.decodeCode(o, d)
+							}},
+						),
+					},
+				},
+				"vault": &commander.BranchNode{
+					Branches: map[string]command.Node{
+						"add": commander.SerialNodes(
+							vaultSlotArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.vaultAdd(o, vaultSlotArg.Get(d))
+							}},
+						),
+						"list": commander.SerialNodes(
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.listVault(o)
+							}},
+						),
+						"remove": commander.SerialNodes(
+							vaultSlotArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.vaultRemove(o, vaultSlotArg.Get(d))
+							}},
+						),
+						"rotate": commander.SerialNodes(
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								return qw.vaultRotate(o)
+							}},
+						),
+					},
+				},
+				"test": commander.SerialNodes(
+					commander.SimpleExecutableProcessor("make " + testTarget),
+				),
+				"mode": commander.SerialNodes(
+					modeArg,
+					commander.ExecutableProcessor(func(o command.Output, d *command.Data) ([]string, error) {
+						if !modeArg.Provided(d) {
+							o.Stdoutln(qw.mode())
+							return nil, nil
+						}
+						lines, err := qw.setMode(modeArg.Get(d))
+						if err != nil {
+							return nil, o.Err(err)
+						}
+						return lines, nil
+					}),
+				),
+				"verify-reproducible": commander.SerialNodes(
+					commander.FlagProcessor(
+						hexFileFlag,
+						hashFlag,
+						codesFlag,
+						codeFlag,
+						secretFlag,
+						vaultCodesFlag,
+						cipherFlag,
+						profileFlag,
+					),
+					verifyConfig,
+					keyboardArg,
+					keymapArg,
+					versionCommand,
+					&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+						return qw.verifyReproducible(o, d, keyboardArg.Get(d), keymapArg.Get(d), versionCommand.Get(d))
+					}},
+				),
+				"doctor": commander.SerialNodes(
+					commander.FlagProcessor(
+						profileFlag,
 					),
-					"set": commander.SerialNodes(
-						qmkDirArg,
-						outputDirArg,
-						&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
-							qw.QMKDir = qmkDirArg.Get(d)
-							qw.OutputDir = outputDirArg.Get(d)
-							qw.changed = true
-							return nil
-						}},
+					commander.SuperSimpleProcessor(func(i *command.Input, d *command.Data) error {
+						// Processing finishes before any executors run, so this
+						// stops the leftover code scrub above.
+						qw.keepLeftoverCodes = true
+						return qw.selectProfile(d)
+					}),
+					&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+						return qw.doctor(o, d)
+					}},
+				),
+				"flash": commander.SerialNodes(
+					commander.FlagProcessor(
+						hexFileFlag,
+						bootloaderFlag,
+						profileFlag,
+						artifactFlag,
+						deployDirFlag,
 					),
+					verifyConfig,
+					keyboardArg,
+					keymapArg,
+					&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+						outputDir := qw.profile().OutputDir
+						return qw.flash(o, d, filepath.Join(outputDir, qw.artifactFile(d, outputDir, keyboardArg.Get(d), keymapArg.Get(d), time.Time{})))
+					}},
+				),
+				"config": &commander.BranchNode{
+					Branches: map[string]command.Node{
+						"list": commander.SerialNodes(
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								p := qw.profile()
+								o.Stdoutf("QMK Directory:    %s\n", p.QMKDir)
+								o.Stdoutf("Output Directory: %s\n", p.OutputDir)
+								if p.Userspace != "" {
+									o.Stdoutf("Userspace:        %s\n", p.Userspace)
+								}
+								if p.CodeFile != "" {
+									o.Stdoutf("Code File:        %s\n", p.CodeFile)
+								}
+								if p.Artifact != "" {
+									o.Stdoutf("Artifact:         %s\n", p.Artifact)
+								}
+								if p.DeployDir != "" {
+									o.Stdoutf("Deploy Directory: %s\n", p.DeployDir)
+								}
+								if qw.Cipher != "" {
+									o.Stdoutf("Cipher:           %s\n", qw.Cipher)
+								}
+								if qw.HeaderTemplate != "" {
+									o.Stdoutf("Header Template:  %s\n", qw.HeaderTemplate)
+								}
+								qw.listFlashers(o)
+								qw.listSizeBudgets(o)
+								qw.listSecrets(o)
+								qw.listProfiles(o)
+								return nil
+							}},
+						),
+						"set": commander.SerialNodes(
+							commander.FlagProcessor(
+								userspaceFlag,
+								codeFileFlag,
+								artifactFlag,
+								deployDirFlag,
+							),
+							qmkDirArg,
+							outputDirArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								np, err := profileSettings(d, qw.profile())
+								if err != nil {
+									return o.Err(err)
+								}
+								qw.updateProfile(func(p *Profile) {
+									*p = *np
+								})
+								return nil
+							}},
+						),
+						"profile": &commander.BranchNode{
+							Branches: map[string]command.Node{
+								"add": commander.SerialNodes(
+									commander.FlagProcessor(
+										userspaceFlag,
+										codeFileFlag,
+										artifactFlag,
+										deployDirFlag,
+									),
+									profileNameArg,
+									qmkDirArg,
+									outputDirArg,
+									&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+										p, err := profileSettings(d, &Profile{})
+										if err != nil {
+											return o.Err(err)
+										}
+										if err := qw.addProfile(profileNameArg.Get(d), p); err != nil {
+											return o.Err(err)
+										}
+										return nil
+									}},
+								),
+								"remove": commander.SerialNodes(
+									profileNameArg,
+									&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+										if err := qw.removeProfile(profileNameArg.Get(d)); err != nil {
+											return o.Err(err)
+										}
+										return nil
+									}},
+								),
+							},
+						},
+						"use": commander.SerialNodes(
+							profileNameArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								if err := qw.useProfile(profileNameArg.Get(d)); err != nil {
+									return o.Err(err)
+								}
+								return nil
+							}},
+						),
+						"cipher": commander.SerialNodes(
+							cipherArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								if _, err := getCipher(cipherArg.Get(d)); err != nil {
+									return o.Err(err)
+								}
+								qw.Cipher = cipherArg.Get(d)
+								qw.changed = true
+								return nil
+							}},
+						),
+						"template": &commander.BranchNode{
+							Branches: map[string]command.Node{
+								"reset": commander.SerialNodes(
+									&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+										qw.HeaderTemplate = ""
+										qw.changed = true
+										return nil
+									}},
+								),
+							},
+							Default: commander.SerialNodes(
+								templateFileArg,
+								&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+									if err := qw.validateHeaderTemplate(templateFileArg.Get(d)); err != nil {
+										return o.Err(err)
+									}
+									qw.HeaderTemplate = templateFileArg.Get(d)
+									qw.changed = true
+									return nil
+								}},
+							),
+						},
+						"budget": &commander.BranchNode{
+							Branches: map[string]command.Node{
+								"remove": commander.SerialNodes(
+									budgetKeyboardArg,
+									&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+										if err := qw.removeSizeBudget(budgetKeyboardArg.Get(d)); err != nil {
+											return o.Err(err)
+										}
+										return nil
+									}},
+								),
+							},
+							Default: commander.SerialNodes(
+								budgetKeyboardArg,
+								sizeBudgetArg,
+								&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+									if err := qw.setSizeBudget(budgetKeyboardArg.Get(d), sizeBudgetArg.Get(d)); err != nil {
+										return o.Err(err)
+									}
+									return nil
+								}},
+							),
+						},
+						"secret": commander.SerialNodes(
+							secretNameArg,
+							secretTypeArg,
+							secretArgsArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								ss := &SecretSource{
+									Type: secretTypeArg.Get(d),
+									Args: secretArgsArg.Get(d),
+								}
+								if err := ss.validate(); err != nil {
+									return o.Err(err)
+								}
+								if qw.Secrets == nil {
+									qw.Secrets = map[string]*SecretSource{}
+								}
+								qw.Secrets[secretNameArg.Get(d)] = ss
+								qw.changed = true
+								return nil
+							}},
+						),
+						"flasher": commander.SerialNodes(
+							bootloaderArg,
+							flasherCmdArg,
+							flasherArgsArg,
+							&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+								if qw.Flashers == nil {
+									qw.Flashers = map[string]*Flasher{}
+								}
+								qw.Flashers[bootloaderArg.Get(d)] = &Flasher{
+									CommandName: flasherCmdArg.Get(d),
+									Args:        flasherArgsArg.Get(d),
+								}
+								qw.changed = true
+								return nil
+							}},
+						),
+					},
 				},
 			},
-		},
-		Default: commander.ShortcutNode(shortcutName, qw, commander.SerialNodes(
-			verifyConfig,
-			commander.FlagProcessor(
-				hexFileFlag,
-				hashFlag,
-				codesFlag,
-			),
-			keyboardArg,
-			keymapArg,
-			versionCommand,
-			&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
-
-				kb := keyboardArg.Get(d)
-				km := keymapArg.Get(d)
-
-				version := versionCommand.Get(d)
-				if len(version) > 6 {
-					version = version[:6]
-				}
-
-				var code1, code2 string
-				if codesFlag.Provided(d) {
-					codes := codesFlag.Get(d)
-					code1, code2 = codes[0], codes[1]
-				}
-
-				if hashFlag.Get(d) {
-					code1 = rot(qw.hash, code1, true)
-					code2 = rot(qw.hash2, code2, true)
-				}
-
-				timedVersion := timeNow().Format("2006-01-02 15:04:05 ") + version
-				if err := osWriteFile(filepath.Join(qw.QMKDir, codeFile), []byte(codeFileContents(timedVersion, code1, code2)), 0644); err != nil {
-					return o.Annotate(err, "failed to write code file")
-				}
-
-				defer func() {
-					if err := osWriteFile(filepath.Join(qw.QMKDir, codeFile), []byte(codeFileContents("auto-generated", "", "")), 0644); err != nil {
-						o.Annotatef(err, "CRITICAL: failed to remove temporary codes")
+			Default: commander.ShortcutNode(shortcutName, qw, commander.SerialNodes(
+				compileFlags,
+				verifyConfig,
+				keyboardArg,
+				keymapArg,
+				versionCommand,
+				&commander.ExecutorProcessor{func(o command.Output, d *command.Data) error {
+					codes, err := qw.codes(o, d)
+					if err != nil {
+						return o.Err(err)
 					}
-				}()
-
-				// Run the qmk command
-				bc := &commander.ShellCommand[string]{
-					CommandName: "qmk",
-					Args: []string{
-						"compile",
-						"--keyboard", kb,
-						"--keymap", km,
-					},
-					ForwardStdout: true,
-				}
-				if _, err := bc.Run(o, d); err != nil {
-					return o.Annotate(err, "failed to run qmk compile")
-				}
-
-				// Copy the output file
-				bf := fmt.Sprintf("%s_%s.%s", slashRegbex.ReplaceAllString(kb, "_"), slashRegbex.ReplaceAllString(km, "_"), hexFileFlag.Get(d))
-				if err := copyFile(filepath.Join(qw.QMKDir, bf), filepath.Join(qw.OutputDir, bf)); err != nil {
-					return o.Annotate(err, "failed to copy qmk files")
-				}
+					return qw.compile(o, d, keyboardArg.Get(d), keymapArg.Get(d), versionCommand.Get(d), codes)
+				}},
+			)),
+		},
+	)
+}
 
-				return nil
-			}},
-		)),
+// compile writes the codes to the code file, runs qmk compile, and copies the
+// resulting artifact to the output directory.
+func (qw *qmkWrapper) compile(o command.Output, d *command.Data, kb, km, version string, codes map[string]string) error {
+	cleanup, err := qw.writeCodeFile(o, d, codes, version, kb, km)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Run the qmk command (the output is hidden for JSON so stdout is valid JSON)
+	p := qw.profile()
+	start := timeNow()
+	lines, err := qw.qmkCompile(o, d, kb, km, !jsonFlag.Get(d))
+	diags := parseDiagnostics(lines)
+	size := parseFirmwareSize(lines)
+	if jsonFlag.Get(d) {
+		if jerr := printCompileReport(o, diags, size); jerr != nil {
+			return o.Err(jerr)
+		}
+	} else {
+		printDiagnostics(o, diags)
+		if size != nil {
+			o.Stdoutf("Firmware size: %s\n", size)
+		}
+	}
+	if err != nil {
+		return o.Annotate(err, "failed to run qmk compile")
+	}
+	// Over budget artifacts aren't copied so they can't be flashed.
+	if err := qw.checkSizeBudget(kb, size); err != nil {
+		return o.Err(err)
+	}
+
+	of, err := qw.saveArtifact(d, kb, km, qw.artifactFile(d, p.QMKDir, kb, km, start), version)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	if flashFlag.Get(d) || deployDirFlag.Provided(d) {
+		return qw.flash(o, d, of)
 	}
+	return nil
+}
+
+// saveArtifact copies the artifact (af, relative to the QMK directory) to the
+// output directory, writes its manifest, and stores it in the artifact
+// history. The path to the copied artifact is returned.
+func (qw *qmkWrapper) saveArtifact(d *command.Data, kb, km, af, version string) (string, error) {
+	p := qw.profile()
+	bf := filepath.Base(af)
+	of := filepath.Join(p.OutputDir, bf)
+	data, err := copyFile(filepath.Join(p.QMKDir, af), of)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy qmk files: %v", err)
+	}
+
+	m := newManifest(kb, km, version, artifactExt(bf), hashFlag.Get(d), data)
+	if err := writeManifest(of, m); err != nil {
+		return "", fmt.Errorf("failed to write build manifest: %v", err)
+	}
+
+	if err := qw.archiveArtifact(bf, data, m); err != nil {
+		return "", fmt.Errorf("failed to save artifact history: %v", err)
+	}
+	return of, nil
 }
 
-func copyFile(from, to string) error {
+// writeCodeFile writes the codes (see qmkWrapper.codes) to the code file and
+// returns a function that removes them again. kb and km are empty if the code
+// file is shared by multiple targets.
+func (qw *qmkWrapper) writeCodeFile(o command.Output, d *command.Data, provided map[string]string, version, kb, km string) (func(), error) {
+	commit := version
+	if len(version) > 6 {
+		version = version[:6]
+	}
+
+	// The provided codes are reused by repeated builds (e.g. `q watch`), so
+	// only a copy is encoded.
+	codes := map[string]string{}
+	for n, c := range provided {
+		codes[n] = c
+	}
+
+	slots := qw.codeSlots()
+	var cipherName string
+	if hashFlag.Get(d) {
+		c, err := qw.cipher(d)
+		if err != nil {
+			return nil, o.Err(err)
+		}
+		cipherName = c.Name()
+		for _, cs := range slots {
+			if err := validateCode(c, cs.Name, cs.HashKey, codes[cs.Name]); err != nil {
+				return nil, o.Err(err)
+			}
+		}
+		for _, cs := range slots {
+			if codes[cs.Name], err = c.Encode(cs.HashKey, codes[cs.Name]); err != nil {
+				return nil, o.Annotatef(err, "failed to encode code %s", cs.Name)
+			}
+		}
+	}
+
+	// Lock the code file before snapshotting it so another build's codes are
+	// never mistaken for the original contents.
+	f := qw.codeFilePath()
+	unlock, err := lockCodeFile(f)
+	if err != nil {
+		return nil, o.Err(err)
+	}
+	written := false
+	defer func() {
+		if !written {
+			unlock()
+		}
+	}()
+
+	// Snapshot the existing code file so it can be restored exactly.
+	original, err := osReadFile(f)
+	if os.IsNotExist(err) {
+		if original, err = qw.codeFileContents(qw.headerData(scrubbedVersion, nil)); err != nil {
+			return nil, o.Err(err)
+		}
+	} else if err != nil {
+		return nil, o.Annotate(err, "failed to read code file")
+	}
+
+	now, err := qw.buildTime(o, d)
+	if err != nil {
+		return nil, o.Err(err)
+	}
+	hd := qw.headerData(now.Format(timedVersionFormat)+version, codes)
+	if err := qw.addGitMetadata(o, d, hd); err != nil {
+		return nil, o.Err(err)
+	}
+	hd.Commit = commit
+	hd.Timestamp = now
+	hd.Keyboard = kb
+	hd.Keymap = km
+	hd.Cipher = cipherName
+	contents, err := qw.codeFileContents(hd)
+	if err != nil {
+		return nil, o.Err(err)
+	}
+	if err := osWriteFile(f, contents, 0644); err != nil {
+		return nil, o.Annotate(err, "failed to write code file")
+	}
+	written = true
+
+	// Codes are removed exactly once, either when the build finishes or when
+	// the process is killed (whichever happens first).
+	var once sync.Once
+	scrub := func() {
+		once.Do(func() {
+			if err := restoreFile(f, original); err != nil {
+				o.Annotatef(err, "CRITICAL: failed to remove temporary codes")
+			}
+			unlock()
+		})
+	}
+	stop := scrubOnSignal(func(sig os.Signal) {
+		o.Stderrf("Received %v; removing temporary codes\n", sig)
+		scrub()
+	})
+
+	return func() {
+		stop()
+		scrub()
+	}, nil
+}
+
+// cipher returns the cipher to encode codes with (the `--cipher` flag, then
+// the configured cipher, then the default).
+func (qw *qmkWrapper) cipher(d *command.Data) (Cipher, error) {
+	name := defaultCipher
+	if cipherFlag.Provided(d) {
+		name = cipherFlag.Get(d)
+	} else if qw.Cipher != "" {
+		name = qw.Cipher
+	}
+	return getCipher(name)
+}
+
+// restoreFile writes the contents to the file and verifies they were written.
+func restoreFile(f string, contents []byte) error {
+	if err := osWriteFile(f, contents, 0644); err != nil {
+		return err
+	}
+	got, err := osReadFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to verify restored file: %v", err)
+	}
+	if !bytes.Equal(got, contents) {
+		return fmt.Errorf("restored file contents don't match the original")
+	}
+	return nil
+}
+
+// qmkCompile runs qmk compile (with any extra args) for the keyboard and keymap
+// in the QMK directory and returns its output. If forward is false, the
+// command's output is hidden (for running multiple compiles at once).
+func (qw *qmkWrapper) qmkCompile(o command.Output, d *command.Data, kb, km string, forward bool, extraArgs ...string) ([]string, error) {
+	args := append([]string{
+		"compile",
+		"--keyboard", kb,
+		"--keymap", km,
+	}, extraArgs...)
+	if qw.reproducible(d) {
+		// QMK embeds the build date and its own git version unless this is set.
+		args = append(args, "-e", "SKIP_VERSION=yes")
+	}
+	bc := &commander.ShellCommand[[]string]{
+		CommandName:   "qmk",
+		Args:          args,
+		Dir:           qw.profile().QMKDir,
+		ForwardStdout: forward,
+		HideStderr:    !forward,
+	}
+	return bc.Run(o, d)
+}
+
+// artifactName returns the name of the file qmk produces for the keyboard and keymap.
+func artifactName(kb, km, ext string) string {
+	return fmt.Sprintf("%s_%s.%s", slashRegbex.ReplaceAllString(kb, "_"), slashRegbex.ReplaceAllString(km, "_"), ext)
+}
+
+// copyFile copies the file and returns the copied contents.
+func copyFile(from, to string) ([]byte, error) {
 	data, err := osReadFile(from)
 	if err != nil {
-		return fmt.Errorf("failed to read input file: %v", err)
+		return nil, fmt.Errorf("failed to read input file: %v", err)
 	}
 	if err := osWriteFile(to, data, 0644); err != nil {
-		return fmt.Errorf("failed to write to output file: %v", err)
+		return nil, fmt.Errorf("failed to write to output file: %v", err)
 	}
-	return nil
+	return data, nil
 }
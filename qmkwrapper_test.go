@@ -1,6 +1,7 @@
 package qmkwrapper
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,6 +17,11 @@ import (
 	"github.com/leep-frog/command/commandtest"
 )
 
+var (
+	// codeFile is the default code file (relative to the QMK directory).
+	codeFile = filepath.Join(userspaceDir, codeFileName)
+)
+
 type readFileResponse struct {
 	expectedFile string
 	contents     string
@@ -40,9 +46,59 @@ func TestMain(t *testing.T) {
 		return &qmkWrapper{
 			QMKDir:    filepath.Join("initial", "qmk", "dir"),
 			OutputDir: filepath.Join("initial", "output", "dir"),
-			hash:      hash1,
-			hash2:     hash2,
+			slots:     defaultSlots(hash1, hash2),
+		}
+	}
+	// Every command checks the code file for codes left over from an interrupted build.
+	scrubbedCodeFile := &readFileResponse{
+		expectedFile: filepath.Join(qw().QMKDir, codeFile),
+		contents: strings.Join([]string{
+			"#pragma once",
+			`#define LEEP_VERSION "auto-generated"`,
+			`#define LEEP_CODE_1 ""`,
+			`#define LEEP_CODE_2 ""`,
+			"",
+		}, "\n"),
+	}
+	// vial returns a profile for a second QMK checkout.
+	vial := func() *Profile {
+		return &Profile{
+			QMKDir:    filepath.Join("vial", "qmk", "dir"),
+			OutputDir: filepath.Join("vial", "output", "dir"),
+		}
+	}
+	vialCodeFile := &readFileResponse{
+		expectedFile: filepath.Join(vial().QMKDir, codeFile),
+		contents:     scrubbedCodeFile.contents,
+	}
+	handMaintainedCodeFile := strings.Join([]string{
+		"#pragma once",
+		`#define LEEP_VERSION "dev"`,
+		`#define LEEP_CODE_1 "default"`,
+		`#define LEEP_CODE_2 ""`,
+		`#define LEEP_EXTRA 1`,
+		"",
+	}, "\n")
+	headerTemplateBytes, err := os.ReadFile(filepath.Join("testdata", "header.tmpl"))
+	if err != nil {
+		t.Fatalf("failed to read header template: %v", err)
+	}
+	headerTemplate := string(headerTemplateBytes)
+	vault := testVault(t, "hunter2", map[string]string{
+		"1": "vault-one",
+		"2": "vault-two",
+	})
+	// cloneVault returns a copy of vault without the removed codes.
+	cloneVault := func(remove ...string) *Vault {
+		v := *vault
+		v.Codes = map[string][]byte{}
+		for n, c := range vault.Codes {
+			v.Codes[n] = c
+		}
+		for _, n := range remove {
+			delete(v.Codes, n)
 		}
+		return &v
 	}
 	for _, test := range []struct {
 		name               string
@@ -50,7 +106,14 @@ func TestMain(t *testing.T) {
 		want               *qmkWrapper
 		readFileResponses  []*readFileResponse
 		writeFileResponses []*writeFileResponse
-		etc                *commandtest.ExecuteTestCase
+		// secrets are the values read from stdin (in order).
+		secrets []string
+		// env are the environment variables that are set.
+		env map[string]string
+		// gitRepos are the directories (other than the QMK directory) that are
+		// git repos.
+		gitRepos []string
+		etc      *commandtest.ExecuteTestCase
 	}{
 		{
 			name: "fails if qmk dir isn't set",
@@ -65,6 +128,10 @@ func TestMain(t *testing.T) {
 					"message 1",
 					"message two",
 				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+				}},
 				WantStderr: "Directory values have not been set (`q config set`)\n",
 				WantErr:    fmt.Errorf("Directory values have not been set (`q config set`)"),
 			},
@@ -82,6 +149,10 @@ func TestMain(t *testing.T) {
 					"message 1",
 					"message two",
 				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+				}},
 				WantStderr: "Directory values have not been set (`q config set`)\n",
 				WantErr:    fmt.Errorf("Directory values have not been set (`q config set`)"),
 			},
@@ -106,8 +177,8 @@ func TestMain(t *testing.T) {
 					Err: fmt.Errorf("version oops"),
 				}},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 				}},
@@ -118,7 +189,17 @@ func TestMain(t *testing.T) {
 		{
 			name: "fails if can't write to file",
 			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
 					expectedData: strings.Join([]string{
@@ -131,6 +212,65 @@ func TestMain(t *testing.T) {
 					err: fmt.Errorf("whoops"),
 				},
 			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"message two",
+				},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantStderr: "failed to write code file: whoops\n",
+				WantErr:    fmt.Errorf("failed to write code file: whoops"),
+			},
+		},
+		{
+			name: "fails if can't lock code file",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+					err:          fmt.Errorf("whoops"),
+				},
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
@@ -144,24 +284,86 @@ func TestMain(t *testing.T) {
 					Args: []string{"rev-parse", "HEAD"},
 					Dir:  qw().QMKDir,
 				}},
-				RunResponses: []*commandtest.FakeRun{{
-					Stdout: []string{"abc123def456"},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantStderr: "failed to lock code file: whoops\n",
+				WantErr:    fmt.Errorf("failed to lock code file: whoops"),
+			},
+		},
+		{
+			name: "fails if another build has the code file locked",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Read lock owner
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					contents:     "5678",
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+					err:          os.ErrExist,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"message two",
+				},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
 				}},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123def456",
 				}},
-				WantStderr: "failed to write code file: whoops\n",
-				WantErr:    fmt.Errorf("failed to write code file: whoops"),
+				WantStderr: "code file is locked by another build (PID 5678); wait for it to finish and try again\n",
+				WantErr:    fmt.Errorf("code file is locked by another build (PID 5678); wait for it to finish and try again"),
 			},
 		},
 		{
 			name: "fails if qmk failure",
 			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -197,6 +399,10 @@ func TestMain(t *testing.T) {
 					{
 						Stdout: []string{"abc123def456"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
@@ -204,8 +410,8 @@ func TestMain(t *testing.T) {
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123def456",
@@ -216,6 +422,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -223,6 +439,7 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
@@ -237,7 +454,17 @@ func TestMain(t *testing.T) {
 		{
 			name: "fails if qmk failure + re-write failure",
 			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -274,6 +501,10 @@ func TestMain(t *testing.T) {
 					{
 						Stdout: []string{"abc123def456"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
@@ -281,8 +512,8 @@ func TestMain(t *testing.T) {
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123def456",
@@ -293,6 +524,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -300,6 +541,7 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
@@ -316,6 +558,11 @@ func TestMain(t *testing.T) {
 			name: "fails if copy read failure",
 			q:    qw(),
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -339,12 +586,19 @@ func TestMain(t *testing.T) {
 					}, "\n"),
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-				err:          fmt.Errorf("rats"),
-			}},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+					err:          fmt.Errorf("rats"),
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
@@ -357,14 +611,18 @@ func TestMain(t *testing.T) {
 					{
 						Stdout: []string{"abc123"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123",
@@ -375,6 +633,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -382,6 +650,7 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
@@ -397,6 +666,11 @@ func TestMain(t *testing.T) {
 			name: "fails if copy write failure",
 			q:    qw(),
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -426,11 +700,18 @@ func TestMain(t *testing.T) {
 					}, "\n"),
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
@@ -443,14 +724,18 @@ func TestMain(t *testing.T) {
 					{
 						Stdout: []string{"abc12"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc12",
@@ -461,6 +746,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -468,6 +763,7 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
@@ -483,6 +779,11 @@ func TestMain(t *testing.T) {
 			name: "succeeds",
 			q:    qw(),
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -499,6 +800,20 @@ func TestMain(t *testing.T) {
 					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
 					expectedData: "abcd",
 				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -511,11 +826,18 @@ func TestMain(t *testing.T) {
 					}, "\n"),
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
@@ -528,14 +850,18 @@ func TestMain(t *testing.T) {
 					{
 						Stdout: []string{"abc123def456"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123def456",
@@ -546,6 +872,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -553,6 +889,7 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
@@ -560,65 +897,75 @@ func TestMain(t *testing.T) {
 			},
 		},
 		{
-			name: "succeeds with multiple keyboard/keymap parts and hex file flag",
-			q:    qw(),
+			name:     "writes git metadata to code file",
+			q:        qw(),
+			gitRepos: []string{filepath.Join(qw().QMKDir, userspaceDir)},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
 					expectedData: strings.Join([]string{
 						"#pragma once",
 						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_GIT_DESCRIBE "0.22.14-5-gabc123d"`,
+						`#define LEEP_DIRTY 1`,
+						`#define LEEP_GIT_BRANCH "develop"`,
+						`#define LEEP_USERSPACE_COMMIT "fedcba987654"`,
 						`#define LEEP_CODE_1 "message 1"`,
 						`#define LEEP_CODE_2 "message two"`,
 						"",
 					}, "\n"),
 				},
-				// Copy write
-				{
-					expectedFile: filepath.Join(qw().OutputDir, "kb_sub_thing_km_more_path.hex"),
-					expectedData: "abcd",
-				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
-					expectedData: strings.Join([]string{
-						"#pragma once",
-						`#define LEEP_VERSION "auto-generated"`,
-						`#define LEEP_CODE_1 ""`,
-						`#define LEEP_CODE_2 ""`,
-						"",
-					}, "\n"),
+					expectedData: scrubbedCodeFile.contents,
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_sub_thing_km_more_path.hex"),
-				contents:     "abcd",
-			}},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
-					"kb/sub\\thing",
-					"km\\more/path",
+					"kb",
+					"km",
 					"--codes",
 					"message 1",
 					"message two",
-					"-x",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
 						Stdout: []string{"abc123def456"},
 					},
 					{
-						Stdout: []string{"so"},
-						Stderr: []string{"se"},
+						Stdout: []string{"0.22.14-5-gabc123d-dirty"},
+					},
+					{
+						Stdout: []string{"develop"},
+					},
+					{
+						Stdout: []string{"fedcba987654"},
+					},
+					// Clean userspace status
+					{},
+					{
+						Err: fmt.Errorf("oops"),
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb/sub\\thing",
-					keymapArg.Name():   "km\\more/path",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
 					codesFlag.Name():   []string{"message 1", "message two"},
-					hexFileFlag.Name(): "hex",
+					hexFileFlag.Name(): "bin",
 					"VERSION":          "abc123def456",
 				}},
 				WantRunContents: []*commandtest.RunContents{
@@ -627,81 +974,77 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  filepath.Join(qw().QMKDir, userspaceDir),
+					},
+					{
+						Name: "git",
+						Args: []string{"status", "--porcelain"},
+						Dir:  filepath.Join(qw().QMKDir, userspaceDir),
+					},
 					{
 						Name: "qmk",
 						Args: []string{
 							"compile",
-							"--keyboard", "kb/sub\\thing",
-							"--keymap", "km\\more/path",
+							"--keyboard", "kb",
+							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
-				WantStdout: "so\n",
-				WantStderr: "se\n",
+				WantStderr: "failed to run qmk compile: failed to execute shell command: oops\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: oops"),
 			},
 		},
 		{
-			name: "succeeds with noop rot (maxRuneChar)",
-			q:    qwHash("abcd", "1234"),
+			name: "fails if git metadata can't be read",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
-				// Write codes to file
-				{
-					expectedFile: filepath.Join(qw().QMKDir, codeFile),
-					expectedData: strings.Join([]string{
-						"#pragma once",
-						`#define LEEP_VERSION "2001-02-03 04:05:06 abc"`,
-						`#define LEEP_CODE_1 "abcd"`,
-						`#define LEEP_CODE_2 "1234"`,
-						"",
-					}, "\n"),
-				},
-				// Copy write
+				// Lock code file
 				{
-					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
-					expectedData: "abcd",
-				},
-				// Write empty strings to file
-				{
-					expectedFile: filepath.Join(qw().QMKDir, codeFile),
-					expectedData: strings.Join([]string{
-						"#pragma once",
-						`#define LEEP_VERSION "auto-generated"`,
-						`#define LEEP_CODE_1 ""`,
-						`#define LEEP_CODE_2 ""`,
-						"",
-					}, "\n"),
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
 					"km",
 					"--codes",
-					"~~~~",
-					"~",
-					"--hash",
+					"message 1",
+					"message two",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
-						Stdout: []string{"abc"},
+						Stdout: []string{"abc123def456"},
 					},
 					{
-						Stdout: []string{"so"},
-						Stderr: []string{"se"},
+						Err: fmt.Errorf("no commits"),
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
-					codesFlag.Name():   []string{"~~~~", "~"},
-					hashFlag.Name():    true,
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
-					"VERSION":          "abc",
+					"VERSION":          "abc123def456",
 				}},
 				WantRunContents: []*commandtest.RunContents{
 					{
@@ -710,82 +1053,80 @@ func TestMain(t *testing.T) {
 						Dir:  qw().QMKDir,
 					},
 					{
-						Name: "qmk",
-						Args: []string{
-							"compile",
-							"--keyboard", "kb",
-							"--keymap", "km",
-						},
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
 					},
 				},
-				WantStdout: "so\n",
-				WantStderr: "se\n",
+				WantStderr: "failed to describe QMK commit: failed to execute shell command: no commits\n",
+				WantErr:    fmt.Errorf("failed to describe QMK commit: failed to execute shell command: no commits"),
 			},
 		},
 		{
-			name: "succeeds with rot",
-			q:    qwHash("abcd", "1234"),
+			name: "reproducible build uses commit time",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
 					expectedData: strings.Join([]string{
 						"#pragma once",
-						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
-						//                    abcd (offsets, 1, 2, 3, 1)
-						`#define LEEP_CODE_1 "bdfe"`,
-						//                    1234 (offsets, 1, 1, 1, 1)
-						`#define LEEP_CODE_2 "2345"`,
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 "message two"`,
 						"",
 					}, "\n"),
 				},
-				// Copy write
-				{
-					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
-					expectedData: "abcd",
-				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
-					expectedData: strings.Join([]string{
-						"#pragma once",
-						`#define LEEP_VERSION "auto-generated"`,
-						`#define LEEP_CODE_1 ""`,
-						`#define LEEP_CODE_2 ""`,
-						"",
-					}, "\n"),
+					expectedData: scrubbedCodeFile.contents,
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
 					"km",
 					"--codes",
-					fmt.Sprintf("%c%c%c", minRune+1, minRune+2, minRune+3),
-					fmt.Sprintf("%c%c%c%c%c", minRune+1, minRune+1, minRune+1, minRune+1, minRune+1),
-					"--hash",
+					"message 1",
+					"message two",
+					"--reproducible",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
-						Stdout: []string{"abc123"},
+						Stdout: []string{"abc123def456"},
 					},
+					// git log
 					{
-						Stdout: []string{"so"},
-						Stderr: []string{"se"},
+						Stdout: []string{"1000000000"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Err: fmt.Errorf("oops"),
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
-					codesFlag.Name():   []string{`!"#`, "!!!!!"},
-					hashFlag.Name():    true,
-					hexFileFlag.Name(): "bin",
-					"VERSION":          "abc123",
+					keyboardArgName:         "kb",
+					keymapArgName:           "km",
+					codesFlag.Name():        []string{"message 1", "message two"},
+					hexFileFlag.Name():      "bin",
+					reproducibleFlag.Name(): true,
+					"VERSION":               "abc123def456",
 				}},
 				WantRunContents: []*commandtest.RunContents{
 					{
@@ -793,82 +1134,96 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
 							"compile",
 							"--keyboard", "kb",
 							"--keymap", "km",
+							"-e", "SKIP_VERSION=yes",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
-				WantStdout: "so\n",
-				WantStderr: "se\n",
+				WantStderr: "failed to run qmk compile: failed to execute shell command: oops\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: oops"),
 			},
 		},
 		{
-			name: "succeeds with rot and empty code",
-			q:    qwHash("abcd", "1234"),
+			name: "SOURCE_DATE_EPOCH makes build reproducible",
+			q:    qw(),
+			env:  map[string]string{sourceDateEpochEnv: "1000000000"},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
 					expectedData: strings.Join([]string{
 						"#pragma once",
-						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
-						`#define LEEP_CODE_1 ""`,
-						//                    1234 (offsets, 1, 1, 1, 1)
-						`#define LEEP_CODE_2 "2345"`,
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 "message two"`,
 						"",
 					}, "\n"),
 				},
-				// Copy write
-				{
-					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
-					expectedData: "abcd",
-				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
-					expectedData: strings.Join([]string{
-						"#pragma once",
-						`#define LEEP_VERSION "auto-generated"`,
-						`#define LEEP_CODE_1 ""`,
-						`#define LEEP_CODE_2 ""`,
-						"",
-					}, "\n"),
+					expectedData: scrubbedCodeFile.contents,
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
 					"km",
 					"--codes",
-					"",
-					fmt.Sprintf("%c%c%c%c%c", minRune+1, minRune+1, minRune+1, minRune+1, minRune+1),
-					"--hash",
+					"message 1",
+					"message two",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
-						Stdout: []string{"abc123"},
+						Stdout: []string{"abc123def456"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
-						Stdout: []string{"so"},
-						Stderr: []string{"se"},
+						Err: fmt.Errorf("oops"),
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
-					codesFlag.Name():   []string{``, "!!!!!"},
-					hashFlag.Name():    true,
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
 					hexFileFlag.Name(): "bin",
-					"VERSION":          "abc123",
+					"VERSION":          "abc123def456",
 				}},
 				WantRunContents: []*commandtest.RunContents{
 					{
@@ -876,23 +1231,87 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
 							"compile",
 							"--keyboard", "kb",
 							"--keymap", "km",
+							"-e", "SKIP_VERSION=yes",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
-				WantStdout: "so\n",
-				WantStderr: "se\n",
+				WantStderr: "failed to run qmk compile: failed to execute shell command: oops\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: oops"),
 			},
 		},
 		{
-			name: "succeeds with re-write error",
+			name: "fails if SOURCE_DATE_EPOCH is invalid",
+			q:    qw(),
+			env:  map[string]string{sourceDateEpochEnv: "yesterday"},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"message two",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+				},
+				WantStderr: "invalid SOURCE_DATE_EPOCH value \"yesterday\" (must be seconds since the Unix epoch)\n",
+				WantErr:    fmt.Errorf("invalid SOURCE_DATE_EPOCH value \"yesterday\" (must be seconds since the Unix epoch)"),
+			},
+		},
+		{
+			name: "succeeds with multiple keyboard/keymap parts and hex file flag",
 			q:    qw(),
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -906,9 +1325,23 @@ func TestMain(t *testing.T) {
 				},
 				// Copy write
 				{
-					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedFile: filepath.Join(qw().OutputDir, "kb_sub_thing_km_more_path.hex"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_sub_thing_km_more_path.hex.manifest.json"),
+					expectedData: manifestData(t, "kb/sub\\thing", "km\\more/path", "abc123def456", "hex", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_sub_thing_km_more_path", "20010203-040506.000000007-abc123.hex"),
 					expectedData: "abcd",
 				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_sub_thing_km_more_path", "20010203-040506.000000007-abc123.hex.manifest.json"),
+					expectedData: manifestData(t, "kb/sub\\thing", "km\\more/path", "abc123def456", "hex", false, "abcd"),
+				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -919,36 +1352,47 @@ func TestMain(t *testing.T) {
 						`#define LEEP_CODE_2 ""`,
 						"",
 					}, "\n"),
-					err: fmt.Errorf("nooooo"),
 				},
 			},
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_sub_thing_km_more_path.hex"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
-					"kb",
-					"km",
+					"kb/sub\\thing",
+					"km\\more/path",
 					"--codes",
 					"message 1",
 					"message two",
+					"-x",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
 						Stdout: []string{"abc123def456"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb/sub\\thing",
+					keymapArgName:      "km\\more/path",
 					codesFlag.Name():   []string{"message 1", "message two"},
-					hexFileFlag.Name(): "bin",
+					hexFileFlag.Name(): "hex",
 					"VERSION":          "abc123def456",
 				}},
 				WantRunContents: []*commandtest.RunContents{
@@ -957,40 +1401,48 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
 							"compile",
-							"--keyboard", "kb",
-							"--keymap", "km",
+							"--keyboard", "kb/sub\\thing",
+							"--keymap", "km\\more/path",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
-				WantStderr: strings.Join([]string{
-					"se",
-					"CRITICAL: failed to remove temporary codes: nooooo",
-					"",
-				}, "\n"),
+				WantStderr: "se\n",
 			},
 		},
 		{
-			name: "succeeds when no codes provided",
-			q:    qw(),
-			readFileResponses: []*readFileResponse{{
-				// Copy file read
-				expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
-				contents:     "abcd",
-			}},
+			name: "succeeds with max rune codes and rot-v2",
+			q:    qwHash("abcd", "1234"),
 			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
 				// Write codes to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
 					expectedData: strings.Join([]string{
 						"#pragma once",
-						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
-						`#define LEEP_CODE_1 ""`,
-						`#define LEEP_CODE_2 ""`,
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc"`,
+						`#define LEEP_CIPHER "rot-v2"`,
+						"#define LEEP_CODE_1 \"`abc\"",
+						`#define LEEP_CODE_2 "0123"`,
 						"",
 					}, "\n"),
 				},
@@ -999,6 +1451,20 @@ func TestMain(t *testing.T) {
 					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
 					expectedData: "abcd",
 				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc", "bin", true, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc", "bin", true, "abcd"),
+				},
 				// Write empty strings to file
 				{
 					expectedFile: filepath.Join(qw().QMKDir, codeFile),
@@ -1011,25 +1477,50 @@ func TestMain(t *testing.T) {
 					}, "\n"),
 				},
 			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{
 					"kb",
 					"km",
+					"--codes",
+					"~~~~",
+					"~",
+					"--hash",
+					"--cipher",
+					"rot-v2",
 				},
 				RunResponses: []*commandtest.FakeRun{
 					{
-						Stdout: []string{"abc123def456"},
+						Stdout: []string{"abc"},
 					},
+					// git describe
+					{},
+					// git branch
+					{},
 					{
 						Stdout: []string{"so"},
 						Stderr: []string{"se"},
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name(): "kb",
-					keymapArg.Name():   "km",
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"~~~~", "~"},
+					hashFlag.Name():    true,
+					cipherFlag.Name():  "rot-v2",
 					hexFileFlag.Name(): "bin",
-					"VERSION":          "abc123def456",
+					"VERSION":          "abc",
 				}},
 				WantRunContents: []*commandtest.RunContents{
 					{
@@ -1037,6 +1528,16 @@ func TestMain(t *testing.T) {
 						Args: []string{"rev-parse", "HEAD"},
 						Dir:  qw().QMKDir,
 					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
 					{
 						Name: "qmk",
 						Args: []string{
@@ -1044,44 +1545,5044 @@ func TestMain(t *testing.T) {
 							"--keyboard", "kb",
 							"--keymap", "km",
 						},
+						Dir: qw().QMKDir,
 					},
 				},
 				WantStdout: "so\n",
 				WantStderr: "se\n",
 			},
 		},
-		// Config tests
 		{
-			name: "lists config",
-			q:    qw(),
+			name: "succeeds with rot",
+			q:    qwHash("abcd", "1234"),
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CIPHER "rot"`,
+						//                    abcd (offsets, 1, 2, 3, 1)
+						`#define LEEP_CODE_1 "bdfe"`,
+						//                    1234 (offsets, 1, 1, 1, 1)
+						`#define LEEP_CODE_2 "2345"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					fmt.Sprintf("%c%c%c", minRune+1, minRune+2, minRune+3),
+					fmt.Sprintf("%c%c%c%c%c", minRune+1, minRune+1, minRune+1, minRune+1, minRune+1),
+					"--hash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+						Stderr: []string{"se"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{`!"#`, "!!!!!"},
+					hashFlag.Name():    true,
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: "se\n",
+			},
+		},
+		{
+			name: "succeeds with rot and empty code",
+			q:    qwHash("abcd", "1234"),
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CIPHER "rot"`,
+						`#define LEEP_CODE_1 ""`,
+						//                    1234 (offsets, 1, 1, 1, 1)
+						`#define LEEP_CODE_2 "2345"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"",
+					fmt.Sprintf("%c%c%c%c%c", minRune+1, minRune+1, minRune+1, minRune+1, minRune+1),
+					"--hash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+						Stderr: []string{"se"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{``, "!!!!!"},
+					hashFlag.Name():    true,
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: "se\n",
+			},
+		},
+		{
+			name: "succeeds with cipher flag",
+			q:    qwHash("abcd", "1234"),
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CIPHER "xor"`,
+						`#define LEEP_CODE_1 "eadbab7f"`,
+						`#define LEEP_CODE_2 "366a1f0d"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"key1",
+					"key2",
+					"--hash",
+					"--cipher",
+					"xor",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"key1", "key2"},
+					hashFlag.Name():    true,
+					cipherFlag.Name():  "xor",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "fails with unknown configured cipher",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Cipher:    "rot13",
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"key1",
+					"key2",
+					"--hash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"key1", "key2"},
+					hashFlag.Name():    true,
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "unknown cipher \"rot13\" (must be one of [rot, rot-v2, xor])\n",
+				WantErr:    fmt.Errorf("unknown cipher \"rot13\" (must be one of [rot, rot-v2, xor])"),
+			},
+		},
+		{
+			name: "succeeds with named code slots",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				slots:     append(defaultSlots("abcd", "1234"), &CodeSlot{Name: "work", HashKey: "12345678"}),
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CIPHER "rot"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						`#define LEEP_CODE_WORK "rv.Hvz2L"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", true, "abcd"),
+				},
+				// Restore original code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--code",
+					"work=ady4",
+					"--hash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codeFlag.Name():    []string{"work=ady4"},
+					hashFlag.Name():    true,
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name:              "fails with unknown code slot",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--code",
+					"vault=secret",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codeFlag.Name():    []string{"vault=secret"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "unknown code slot \"vault\" (must be one of [1, 2])\n",
+				WantErr:    fmt.Errorf("unknown code slot \"vault\" (must be one of [1, 2])"),
+			},
+		},
+		{
+			name:              "fails with invalid named code",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--code",
+					"secret",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codeFlag.Name():    []string{"secret"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "invalid --code value (must be NAME=VALUE)\n",
+				WantErr:    fmt.Errorf("invalid --code value (must be NAME=VALUE)"),
+			},
+		},
+		{
+			name:              "fails if code slot is provided more than once",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"one",
+					"two",
+					"--code",
+					"1=uno",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"one", "two"},
+					codeFlag.Name():    []string{"1=uno"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "code 1 provided more than once\n",
+				WantErr:    fmt.Errorf("code 1 provided more than once"),
+			},
+		},
+		{
+			name: "succeeds with codes from secrets",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Secrets: map[string]*SecretSource{
+					"work":  {Type: "env", Args: []string{"WORK_CODE"}},
+					"vault": {Type: "command", Args: []string{"pass", "show", "vault"}},
+				},
+			},
+			env: map[string]string{"WORK_CODE": "env-secret"},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "env-secret"`,
+						`#define LEEP_CODE_2 "pass-secret"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", false, "abcd"),
+				},
+				// Restore original code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--secret",
+					"1=work",
+					"2=vault",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"pass-secret"},
+					},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					secretFlag.Name():  []string{"1=work", "2=vault"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "pass",
+						Args: []string{"show", "vault"},
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "fails if secret env variable isn't set",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Secrets: map[string]*SecretSource{
+					"work": {Type: "env", Args: []string{"WORK_CODE"}},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--secret",
+					"1=work",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					secretFlag.Name():  []string{"1=work"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "failed to read secret \"work\" for code 1: environment variable WORK_CODE is not set\n",
+				WantErr:    fmt.Errorf("failed to read secret \"work\" for code 1: environment variable WORK_CODE is not set"),
+			},
+		},
+		{
+			name:              "fails with unknown secret",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--secret",
+					"1=work",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					secretFlag.Name():  []string{"1=work"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "unknown secret \"work\" (`q config secret`)\n",
+				WantErr:    fmt.Errorf("unknown secret \"work\" (`q config secret`)"),
+			},
+		},
+		{
+			name: "succeeds with codes from vault",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			secrets: []string{"hunter2"},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "vault-one"`,
+						`#define LEEP_CODE_2 "vault-two"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123", "bin", false, "abcd"),
+				},
+				// Restore original code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--vault-codes",
+					"1,2",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					vaultCodesFlag.Name(): "1,2",
+					hexFileFlag.Name():    "bin",
+					"VERSION":             "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "fails with incorrect vault passphrase",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			secrets:           []string{"hunter3"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--vault-codes",
+					"1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					vaultCodesFlag.Name(): "1",
+					hexFileFlag.Name():    "bin",
+					"VERSION":             "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "incorrect vault passphrase\n",
+				WantErr:    fmt.Errorf("incorrect vault passphrase"),
+			},
+		},
+		{
+			name: "succeeds with header template",
+			q: &qmkWrapper{
+				QMKDir:         qw().QMKDir,
+				OutputDir:      qw().OutputDir,
+				HeaderTemplate: filepath.Join("testdata", "header.tmpl"),
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_KEYBOARD "kb"`,
+						`#define LEEP_BUILD_ID "KB-abc123def456"`,
+						`#define LEEP_CODE_1 "one"`,
+						`#define LEEP_CODE_2 "two"`,
+						`#define LEEP_HAS_CODE_1`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Restore original code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Read header template
+				{
+					expectedFile: filepath.Join("testdata", "header.tmpl"),
+					contents:     headerTemplate,
+				},
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"one",
+					"two",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"one", "two"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "succeeds with re-write error",
+			q:    qw(),
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 "message two"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+					err: fmt.Errorf("nooooo"),
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"message two",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+						Stderr: []string{"se"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: strings.Join([]string{
+					"se",
+					"CRITICAL: failed to remove temporary codes: nooooo",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "succeeds when no codes provided",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+						Stderr: []string{"se"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: "se\n",
+			},
+		},
+		{
+			name: "succeeds with flash",
+			q:    qw(),
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--flash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+					{
+						Stdout: []string{"flashing"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					flashFlag.Name():   true,
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{"flash", filepath.Join(qw().OutputDir, "kb_km.bin")},
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"so",
+					"flashing",
+					fmt.Sprintf("Successfully flashed %s", filepath.Join(qw().OutputDir, "kb_km.bin")),
+					"",
+				}, "\n"),
+			},
+		},
+		// Batch tests
+		{
+			name: "batch compiles all targets",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					contents:     `[{"keyboard": "kb/sub", "keymap": "km"}, {"keyboard": "kb2", "keymap": "km2", "artifact": "hex"}]`,
+				},
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_sub_km.bin"),
+					contents:     "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb2_km2.hex"),
+					contents:     "efgh",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 "message two"`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_sub_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_sub_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb/sub", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_sub_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_sub_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb/sub", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb2_km2.hex"),
+					expectedData: "efgh",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb2_km2.hex.manifest.json"),
+					expectedData: manifestData(t, "kb2", "km2", "abc123def456", "hex", false, "efgh"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb2_km2", "20010203-040506.000000007-abc123.hex"),
+					expectedData: "efgh",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb2_km2", "20010203-040506.000000007-abc123.hex.manifest.json"),
+					expectedData: manifestData(t, "kb2", "km2", "abc123def456", "hex", false, "efgh"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"batch",
+					filepath.Join("testdata", "targets.json"),
+					"--codes",
+					"message 1",
+					"message two",
+					"--workers",
+					"1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+						Stderr: []string{"se"},
+					},
+					{
+						Stdout: []string{"so2"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					targetsFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					codesFlag.Name():      []string{"message 1", "message two"},
+					hexFileFlag.Name():    "bin",
+					workersFlag.Name():    1,
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb/sub",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb2",
+							"--keymap", "km2",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"TARGET     RESULT  DURATION",
+					"kb/sub:km  PASS    0s",
+					"kb2:km2    PASS    0s",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "batch reports failed targets",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					contents:     `[{"keyboard": "kb/sub", "keymap": "km"}, {"keyboard": "kb2", "keymap": "km2"}]`,
+				},
+				// Snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb2_km2.bin"),
+					contents:     "efgh",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb2_km2.bin"),
+					expectedData: "efgh",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb2_km2.bin.manifest.json"),
+					expectedData: manifestData(t, "kb2", "km2", "abc123def456", "bin", false, "efgh"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb2_km2", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "efgh",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb2_km2", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb2", "km2", "abc123def456", "bin", false, "efgh"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"batch",
+					filepath.Join("testdata", "targets.json"),
+					"-w",
+					"1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Err: fmt.Errorf("oops"),
+					},
+					{},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					targetsFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					hexFileFlag.Name():    "bin",
+					workersFlag.Name():    1,
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb/sub",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb2",
+							"--keymap", "km2",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"TARGET     RESULT  DURATION",
+					"kb/sub:km  FAIL    0s",
+					"kb2:km2    PASS    0s",
+					"",
+				}, "\n"),
+				WantStderr: strings.Join([]string{
+					"kb/sub:km: failed to run qmk compile: failed to execute shell command: oops",
+					"1 of 2 targets failed",
+					"",
+				}, "\n"),
+				WantErr: fmt.Errorf("1 of 2 targets failed"),
+			},
+		},
+		{
+			name: "batch fails on invalid targets",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					contents:     `[{"keyboard": "kb"}]`,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"batch", filepath.Join("testdata", "targets.json")},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					targetsFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					hexFileFlag.Name():    "bin",
+					workersFlag.Name():    4,
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "target 0 is missing a keyboard or keymap\n",
+				WantErr:    fmt.Errorf("target 0 is missing a keyboard or keymap"),
+			},
+		},
+		{
+			name: "batch fails on invalid target artifact",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					contents:     `[{"keyboard": "kb", "keymap": "km", "artifact": "../x"}]`,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"batch", filepath.Join("testdata", "targets.json")},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					targetsFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					hexFileFlag.Name():    "bin",
+					workersFlag.Name():    4,
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "target 0: invalid artifact type \"../x\" (must be one of [bin, hex, uf2])\n",
+				WantErr:    fmt.Errorf("target 0: invalid artifact type \"../x\" (must be one of [bin, hex, uf2])"),
+			},
+		},
+		{
+			name:              "batch fails on non-positive workers",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"batch", filepath.Join("testdata", "targets.json"), "-w", "0"},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					targetsFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "targets.json"),
+					hexFileFlag.Name():    "bin",
+					workersFlag.Name():    0,
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "workers must be positive; got 0\n",
+				WantErr:    fmt.Errorf("workers must be positive; got 0"),
+			},
+		},
+		// Flash tests
+		{
+			name: "flash fails if config isn't set",
+			q:    &qmkWrapper{},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					hexFileFlag.Name(): "bin",
+				}},
+				WantStderr: "Directory values have not been set (`q config set`)\n",
+				WantErr:    fmt.Errorf("Directory values have not been set (`q config set`)"),
+			},
+		},
+		{
+			name:              "flashes with default flasher",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb/sub", "km"},
+				RunResponses: []*commandtest.FakeRun{{
+					Stdout: []string{"flashing"},
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "qmk",
+					Args: []string{"flash", filepath.Join(qw().OutputDir, "kb_sub_km.bin")},
+				}},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb/sub",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+				}},
+				WantStdout: strings.Join([]string{
+					"flashing",
+					fmt.Sprintf("Successfully flashed %s", filepath.Join(qw().OutputDir, "kb_sub_km.bin")),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name:              "flashes with built-in bootloader flasher",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:         []string{"flash", "kb", "km", "-x", "--bootloader", "caterina"},
+				RunResponses: []*commandtest.FakeRun{{}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "avrdude",
+					Args: []string{"-p", "atmega32u4", "-c", "avr109", "-P", "/dev/ttyACM0", "-U", fmt.Sprintf("flash:w:%s:i", filepath.Join(qw().OutputDir, "kb_km.hex"))},
+				}},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					hexFileFlag.Name():    "hex",
+					bootloaderFlag.Name(): "caterina",
+				}},
+				WantStdout: fmt.Sprintf("Successfully flashed %s\n", filepath.Join(qw().OutputDir, "kb_km.hex")),
+			},
+		},
+		{
+			name: "flashes with configured flasher",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Flashers: map[string]*Flasher{
+					"caterina": {
+						CommandName: "fake-flasher",
+						Args:        []string{"--in", "{file}", "--reset"},
+					},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:         []string{"flash", "kb", "km", "-b", "caterina"},
+				RunResponses: []*commandtest.FakeRun{{}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "fake-flasher",
+					Args: []string{"--in", filepath.Join(qw().OutputDir, "kb_km.bin"), "--reset"},
+				}},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					hexFileFlag.Name():    "bin",
+					bootloaderFlag.Name(): "caterina",
+				}},
+				WantStdout: fmt.Sprintf("Successfully flashed %s\n", filepath.Join(qw().OutputDir, "kb_km.bin")),
+			},
+		},
+		{
+			name:              "flash fails for unknown bootloader",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km", "-b", "unknown"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					hexFileFlag.Name():    "bin",
+					bootloaderFlag.Name(): "unknown",
+				}},
+				WantStderr: "no flasher configured for bootloader \"unknown\" (`q config flasher`)\n",
+				WantErr:    fmt.Errorf("no flasher configured for bootloader \"unknown\" (`q config flasher`)"),
+			},
+		},
+		{
+			name:              "flash fails for unsupported artifact type",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km", "-b", "caterina"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					hexFileFlag.Name():    "bin",
+					bootloaderFlag.Name(): "caterina",
+				}},
+				WantStderr: "flasher for bootloader \"caterina\" does not support \"bin\" artifacts\n",
+				WantErr:    fmt.Errorf("flasher for bootloader \"caterina\" does not support \"bin\" artifacts"),
+			},
+		},
+		{
+			name: "flash copies uf2 artifact to UF2 drive",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.uf2"),
+					contents:     "uf2 contents",
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				{
+					expectedFile: filepath.Join("testdata", "uf2", "RPI-RP2", "kb_km.uf2"),
+					expectedData: "uf2 contents",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km", "--artifact", "uf2", "--deploy-dir", filepath.Join("testdata", "uf2")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:      "kb",
+					keymapArgName:        "km",
+					hexFileFlag.Name():   "bin",
+					artifactFlag.Name():  "uf2",
+					deployDirFlag.Name(): filepath.Join("testdata", "uf2"),
+				}},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("Waiting for a UF2 drive in %s (put the keyboard into bootloader mode)", filepath.Join("testdata", "uf2")),
+					fmt.Sprintf("Successfully copied %s to %s", filepath.Join(qw().OutputDir, "kb_km.uf2"), filepath.Join("testdata", "uf2", "RPI-RP2")),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "flash uses configured deploy directory for uf2 artifacts",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Artifact:  "uf2",
+				DeployDir: filepath.Join("testdata", "uf2", "RPI-RP2"),
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.uf2"),
+					contents:     "uf2 contents",
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				{
+					expectedFile: filepath.Join("testdata", "uf2", "RPI-RP2", "kb_km.uf2"),
+					expectedData: "uf2 contents",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+				}},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("Waiting for a UF2 drive in %s (put the keyboard into bootloader mode)", filepath.Join("testdata", "uf2", "RPI-RP2")),
+					fmt.Sprintf("Successfully copied %s to %s", filepath.Join(qw().OutputDir, "kb_km.uf2"), filepath.Join("testdata", "uf2", "RPI-RP2")),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name:              "flash fails to copy non-uf2 artifact to UF2 drive",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km", "--deploy-dir", filepath.Join("testdata", "uf2")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:      "kb",
+					keymapArgName:        "km",
+					hexFileFlag.Name():   "bin",
+					deployDirFlag.Name(): filepath.Join("testdata", "uf2"),
+				}},
+				WantStderr: fmt.Sprintf("only uf2 artifacts can be copied to a UF2 drive (got %s)\n", filepath.Join(qw().OutputDir, "kb_km.bin")),
+				WantErr:    fmt.Errorf("only uf2 artifacts can be copied to a UF2 drive (got %s)", filepath.Join(qw().OutputDir, "kb_km.bin")),
+			},
+		},
+		{
+			name: "flash fails for invalid artifact type",
+			q:    qw(),
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km", "--artifact", "elf"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					hexFileFlag.Name():  "bin",
+					artifactFlag.Name(): "elf",
+				}},
+				WantStderr: "invalid artifact type \"elf\" (must be one of [bin, hex, uf2])\n",
+				WantErr:    fmt.Errorf("invalid artifact type \"elf\" (must be one of [bin, hex, uf2])"),
+			},
+		},
+		{
+			name:              "flash fails if flasher fails",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"flash", "kb", "km"},
+				RunResponses: []*commandtest.FakeRun{{
+					Stderr: []string{"no device"},
+					Err:    fmt.Errorf("oops"),
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "qmk",
+					Args: []string{"flash", filepath.Join(qw().OutputDir, "kb_km.bin")},
+				}},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+				}},
+				WantStderr: strings.Join([]string{
+					"no device",
+					fmt.Sprintf("failed to flash %s: failed to execute shell command: oops", filepath.Join(qw().OutputDir, "kb_km.bin")),
+					"",
+				}, "\n"),
+				WantErr: fmt.Errorf("failed to flash %s: failed to execute shell command: oops", filepath.Join(qw().OutputDir, "kb_km.bin")),
+			},
+		},
+		// Code file restoration tests
+		{
+			name: "restores hand-maintained code file",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				// Snapshot code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Restore code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: handMaintainedCodeFile,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "restores generated code file if none existed",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					err:          os.ErrNotExist,
+				},
+				// Snapshot code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					err:          os.ErrNotExist,
+				},
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Restore code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "auto-generated"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+			},
+		},
+		{
+			name: "fails if restored code file doesn't match",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				// Snapshot code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Restore code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: handMaintainedCodeFile,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: "CRITICAL: failed to remove temporary codes: restored file contents don't match the original\n",
+			},
+		},
+		{
+			name: "fails if restored code file can't be verified",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				// Snapshot code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					contents:     handMaintainedCodeFile,
+				},
+				{
+					// Copy file read
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "abcd",
+				},
+				// Verify restored code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					err:          fmt.Errorf("oops"),
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 ""`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Copy write
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin"),
+					expectedData: "abcd",
+				},
+				// Write manifest
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "kb_km.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Write history
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin"),
+					expectedData: "abcd",
+				},
+				{
+					expectedFile: filepath.Join(qw().OutputDir, "history", "kb_km", "20010203-040506.000000007-abc123.bin.manifest.json"),
+					expectedData: manifestData(t, "kb", "km", "abc123def456", "bin", false, "abcd"),
+				},
+				// Restore code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: handMaintainedCodeFile,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{"so"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: "so\n",
+				WantStderr: "CRITICAL: failed to remove temporary codes: failed to verify restored file: oops\n",
+			},
+		},
+		{
+			name: "fails if code file can't be read",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					err:          fmt.Errorf("oops"),
+				},
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "failed to read code file: oops\n",
+				WantErr:    fmt.Errorf("failed to read code file: oops"),
+			},
+		},
+		// Leftover code tests
+		{
+			name: "removes codes left over from an interrupted build",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				contents: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+					`#define LEEP_CODE_1 "message 1"`,
+					`#define LEEP_CODE_2 "message two"`,
+					"",
+				}, "\n"),
+			}, {
+				expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+				err:          os.ErrNotExist,
+			}},
+			writeFileResponses: []*writeFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				expectedData: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "auto-generated"`,
+					`#define LEEP_CODE_1 ""`,
+					`#define LEEP_CODE_2 ""`,
+					"",
+				}, "\n"),
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+				WantStderr: fmt.Sprintf("WARNING: %s contains codes from an interrupted build (version \"2001-02-03 04:05:06 abc123\"); removing them\n", filepath.Join(qw().QMKDir, codeFile)),
+			},
+		},
+		{
+			name: "fails if leftover codes can't be removed",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				contents: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+					`#define LEEP_CODE_1 "message 1"`,
+					`#define LEEP_CODE_2 "message two"`,
+					"",
+				}, "\n"),
+			}, {
+				expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+				err:          os.ErrNotExist,
+			}},
+			writeFileResponses: []*writeFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				expectedData: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "auto-generated"`,
+					`#define LEEP_CODE_1 ""`,
+					`#define LEEP_CODE_2 ""`,
+					"",
+				}, "\n"),
+				err: fmt.Errorf("oops"),
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStderr: strings.Join([]string{
+					fmt.Sprintf("WARNING: %s contains codes from an interrupted build (version \"2001-02-03 04:05:06 abc123\"); removing them", filepath.Join(qw().QMKDir, codeFile)),
+					"CRITICAL: failed to remove leftover codes: oops",
+					"",
+				}, "\n"),
+				WantErr: fmt.Errorf("CRITICAL: failed to remove leftover codes: oops"),
+			},
+		},
+		{
+			name: "removes codes left over from an interrupted build with a stale lock",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				contents: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+					`#define LEEP_CODE_1 "message 1"`,
+					`#define LEEP_CODE_2 "message two"`,
+					"",
+				}, "\n"),
+			}, {
+				expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+				contents:     "9999",
+			}},
+			writeFileResponses: []*writeFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				expectedData: scrubbedCodeFile.contents,
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+				WantStderr: fmt.Sprintf("WARNING: %s contains codes from an interrupted build (version \"2001-02-03 04:05:06 abc123\"); removing them\n", filepath.Join(qw().QMKDir, codeFile)),
+			},
+		},
+		{
+			name: "doesn't remove codes of a running build",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				contents: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+					`#define LEEP_CODE_1 "message 1"`,
+					`#define LEEP_CODE_2 "message two"`,
+					"",
+				}, "\n"),
+			}, {
+				expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+				contents:     "5678\n",
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "ignores missing code file",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				err:          os.ErrNotExist,
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "warns if code file can't be read",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, codeFile),
+				err:          fmt.Errorf("oops"),
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+				WantStderr: fmt.Sprintf("WARNING: failed to check %s for leftover codes: oops\n", filepath.Join(qw().QMKDir, codeFile)),
+			},
+		},
+		{
+			name: "removes codes left over in configured code file",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Userspace: "other",
+				CodeFile:  filepath.Join("keyboards", "kb", "codes.h"),
+			},
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, "keyboards", "kb", "codes.h"),
+				contents: strings.Join([]string{
+					"#pragma once",
+					`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+					`#define LEEP_CODE_1 "message 1"`,
+					`#define LEEP_CODE_2 "message two"`,
+					"",
+				}, "\n"),
+			}, {
+				expectedFile: filepath.Join(qw().QMKDir, "keyboards", "kb", "codes.h") + lockFileSuffix,
+				err:          os.ErrNotExist,
+			}},
+			writeFileResponses: []*writeFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, "keyboards", "kb", "codes.h"),
+				expectedData: scrubbedCodeFile.contents,
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Userspace:        other",
+					fmt.Sprintf("Code File:        %s", filepath.Join("keyboards", "kb", "codes.h")),
+					"",
+				}, "\n"),
+				WantStderr: fmt.Sprintf("WARNING: %s contains codes from an interrupted build (version \"2001-02-03 04:05:06 abc123\"); removing them\n", filepath.Join(qw().QMKDir, "keyboards", "kb", "codes.h")),
+			},
+		},
+		{
+			name: "checks code file in configured userspace",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Userspace: "other",
+			},
+			readFileResponses: []*readFileResponse{{
+				expectedFile: filepath.Join(qw().QMKDir, "users", "other", "v2", "leep_codes_v2.h"),
+				contents:     scrubbedCodeFile.contents,
+			}},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Userspace:        other",
+					"",
+				}, "\n"),
+			},
+		},
+		// Codes tests
+		{
+			name:              "encodes code",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"ady4"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "encode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStdout: "rv.Hvz2L\n",
+			},
+		},
+		{
+			name:              "encodes code with cipher",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"key1"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "encode", "2", "--cipher", "xor"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "2",
+					cipherFlag.Name():  "xor",
+				}},
+				WantStdout: "eadbab7f\n",
+			},
+		},
+		{
+			name:              "decodes code",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"rv.Hvz2L"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStdout: "ady4ady4\n",
+			},
+		},
+		{
+			name:              "decodes code with rot-v2",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"*1--4007"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "1", "--cipher", "rot-v2"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+					cipherFlag.Name():  "rot-v2",
+				}},
+				WantStdout: "x~yx~yx~\n",
+			},
+		},
+		{
+			name:              "decode fails for xor",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "2", "--cipher", "xor"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "2",
+					cipherFlag.Name():  "xor",
+				}},
+				WantStderr: "xor codes can't be decoded with the hash key\n",
+				WantErr:    fmt.Errorf("xor codes can't be decoded with the hash key"),
+			},
+		},
+		{
+			name:              "decode fails for invalid encoded code",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"~"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStderr: "failed to decode code 1: invalid data: invalid character '~' at position 1 (rot only supports ' ' through '}')\n",
+				WantErr:    fmt.Errorf("failed to decode code 1: invalid data: invalid character '~' at position 1 (rot only supports ' ' through '}')"),
+			},
+		},
+		{
+			name:              "decode fails if encoded code can't be read",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStderr: "failed to read encoded code: no input provided\n",
+				WantErr:    fmt.Errorf("failed to read encoded code: no input provided"),
+			},
+		},
+		{
+			name:              "codes fails for unknown code number",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "encode", "3"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "3",
+				}},
+				WantStderr: "unknown code slot \"3\" (must be one of [1, 2])\n",
+				WantErr:    fmt.Errorf("unknown code slot \"3\" (must be one of [1, 2])"),
+			},
+		},
+		{
+			name:              "codes fails if no hash key is embedded",
+			q:                 qwHash("12345678", ""),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "decode", "2"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "2",
+				}},
+				WantStderr: "no hash key is embedded for code 2\n",
+				WantErr:    fmt.Errorf("no hash key is embedded for code 2"),
+			},
+		},
+		{
+			name:              "codes fails if input can't be read",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "encode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStderr: "failed to read code: no input provided\n",
+				WantErr:    fmt.Errorf("failed to read code: no input provided"),
+			},
+		},
+		{
+			name:              "fails if code isn't in the cipher alphabet",
+			q:                 qwHash("abcd", "1234"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"key1",
+					"k~y2",
+					"--hash",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"key1", "k~y2"},
+					hashFlag.Name():    true,
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "invalid code 2: invalid character '~' at position 2 (rot only supports ' ' through '}')\n",
+				WantErr:    fmt.Errorf("invalid code 2: invalid character '~' at position 2 (rot only supports ' ' through '}')"),
+			},
+		},
+		{
+			name:              "fails if embedded hash key isn't in the cipher alphabet",
+			q:                 qwHash("ab\tcd", "1234"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"key1",
+					"key2",
+					"--hash",
+					"--cipher",
+					"rot-v2",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123"},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"key1", "key2"},
+					hashFlag.Name():    true,
+					cipherFlag.Name():  "rot-v2",
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123",
+				}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "git",
+					Args: []string{"rev-parse", "HEAD"},
+					Dir:  qw().QMKDir,
+				}},
+				WantStderr: "invalid hash key for code 1: invalid character '\\t' at position 3 (rot-v2 only supports ' ' through '~')\n",
+				WantErr:    fmt.Errorf("invalid hash key for code 1: invalid character '\\t' at position 3 (rot-v2 only supports ' ' through '~')"),
+			},
+		},
+		{
+			name:              "codes fails if input isn't in the cipher alphabet",
+			q:                 qwHash("12345678", "abcd"),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			secrets:           []string{"ady~"},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"codes", "encode", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					codeSlotArg.Name(): "1",
+				}},
+				WantStderr: "invalid code 1: invalid character '~' at position 4 (rot only supports ' ' through '}')\n",
+				WantErr:    fmt.Errorf("invalid code 1: invalid character '~' at position 4 (rot only supports ' ' through '}')"),
+			},
+		},
+		// Vault tests
+		{
+			name: "lists vault codes",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"vault", "list"},
+				WantStdout: "1\n2\n",
+			},
+		},
+		{
+			name: "removes vault code",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault("1"),
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "remove", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "1",
+				}},
+			},
+		},
+		{
+			name:              "fails to remove unknown vault code",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "remove", "1"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "1",
+				}},
+				WantStderr: "no code \"1\" in the vault\n",
+				WantErr:    fmt.Errorf("no code \"1\" in the vault"),
+			},
+		},
+		{
+			name:              "fails to add vault code for unknown slot",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "add", "work"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "work",
+				}},
+				WantStderr: "unknown code slot \"work\" (must be one of [1, 2])\n",
+				WantErr:    fmt.Errorf("unknown code slot \"work\" (must be one of [1, 2])"),
+			},
+		},
+		{
+			name:              "fails to create vault if passphrases don't match",
+			q:                 qw(),
+			secrets:           []string{"hunter2", "hunter3", "new-code"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "add", "2"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "2",
+				}},
+				WantStderr: "vault passphrases don't match\n",
+				WantErr:    fmt.Errorf("vault passphrases don't match"),
+			},
+		},
+		{
+			name:              "fails to create vault if passphrase isn't confirmed",
+			q:                 qw(),
+			secrets:           []string{"hunter2"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "add", "2"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "2",
+				}},
+				WantStderr: "failed to read new vault passphrase: no input provided\n",
+				WantErr:    fmt.Errorf("failed to read new vault passphrase: no input provided"),
+			},
+		},
+		{
+			name: "fails to add vault code with incorrect passphrase",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			secrets:           []string{"hunter3", "new-code"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"vault", "add", "2"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					vaultSlotArg.Name(): "2",
+				}},
+				WantStderr: "failed to add code \"2\" to the vault: incorrect vault passphrase\n",
+				WantErr:    fmt.Errorf("failed to add code \"2\" to the vault: incorrect vault passphrase"),
+			},
+		},
+		{
+			name:              "fails to rotate empty vault",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"vault", "rotate"},
+				WantStderr: "vault is empty (`q vault add`)\n",
+				WantErr:    fmt.Errorf("vault is empty (`q vault add`)"),
+			},
+		},
+		{
+			name: "fails to rotate vault with incorrect passphrase",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			secrets:           []string{"hunter3", "correct horse", "correct horse"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"vault", "rotate"},
+				WantStderr: "failed to rotate vault passphrase: incorrect vault passphrase\n",
+				WantErr:    fmt.Errorf("failed to rotate vault passphrase: incorrect vault passphrase"),
+			},
+		},
+		{
+			name: "fails to rotate vault if new passphrases don't match",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			secrets:           []string{"hunter2", "correct horse", "correct hrose"},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"vault", "rotate"},
+				WantStderr: "vault passphrases don't match\n",
+				WantErr:    fmt.Errorf("vault passphrases don't match"),
+			},
+		},
+		// Config tests
+		{
+			name:              "lists config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name:              "Writes config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+				OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "set", filepath.Join("testdata", "qmk"), filepath.Join("testdata", "out", "put")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+				}},
+			},
+		},
+		{
+			name:              "Writes flasher config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Flashers: map[string]*Flasher{
+					"rp2040": {
+						CommandName: "picotool",
+						Args:        []string{"load", "{file}", "-f"},
+					},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "flasher", "rp2040", "picotool", "load", "{file}", "-f"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					bootloaderArg.Name():  "rp2040",
+					flasherCmdArg.Name():  "picotool",
+					flasherArgsArg.Name(): []string{"load", "{file}", "-f"},
+				}},
+			},
+		},
+		{
+			name: "lists config with flashers",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Flashers: map[string]*Flasher{
+					"rp2040": {
+						CommandName: "picotool",
+						Args:        []string{"load", "{file}"},
+					},
+					"caterina": {
+						CommandName: "avrdude",
+					},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Flashers:",
+					"  caterina: avrdude",
+					"  rp2040: picotool load {file}",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name:              "Writes size budget config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				SizeBudgets: map[string]*SizeBudget{
+					"planck/rev6": {MinPercentFree: 10},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "budget", "planck/rev6", "10%"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					budgetKeyboardArg.Name(): "planck/rev6",
+					sizeBudgetArg.Name():     "10%",
+				}},
+			},
+		},
+		{
+			name:              "fails to write invalid size budget config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "budget", "planck/rev6", "28KB"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					budgetKeyboardArg.Name(): "planck/rev6",
+					sizeBudgetArg.Name():     "28KB",
+				}},
+				WantStderr: "invalid size budget \"28KB\" (must be bytes or percent of flash to keep free, e.g. 28000 or 10%)\n",
+				WantErr:    fmt.Errorf("invalid size budget \"28KB\" (must be bytes or percent of flash to keep free, e.g. 28000 or 10%%)"),
+			},
+		},
+		{
+			name: "Removes size budget config",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				SizeBudgets: map[string]*SizeBudget{
+					"planck/rev6": {MinPercentFree: 10},
+					"crkbd":       {MaxBytes: 28000},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				SizeBudgets: map[string]*SizeBudget{
+					"crkbd": {MaxBytes: 28000},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "budget", "remove", "planck/rev6"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					budgetKeyboardArg.Name(): "planck/rev6",
+				}},
+			},
+		},
+		{
+			name:              "fails to remove unknown size budget",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "budget", "remove", "planck/rev6"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					budgetKeyboardArg.Name(): "planck/rev6",
+				}},
+				WantStderr: "no size budget for keyboard \"planck/rev6\"\n",
+				WantErr:    fmt.Errorf("no size budget for keyboard \"planck/rev6\""),
+			},
+		},
+		{
+			name: "lists config with size budgets",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				SizeBudgets: map[string]*SizeBudget{
+					"planck/rev6": {MinPercentFree: 10},
+					"crkbd":       {MaxBytes: 28000},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Size Budgets:",
+					"  crkbd: 28000 bytes",
+					"  planck/rev6: 10% free",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "Writes cipher config",
+			q:    qw(),
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Cipher:    "xor",
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "cipher", "xor"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					cipherArg.Name(): "xor",
+				}},
+			},
+		},
+		{
+			name:              "fails to write unknown cipher config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "cipher", "rot13"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					cipherArg.Name(): "rot13",
+				}},
+				WantStderr: "unknown cipher \"rot13\" (must be one of [rot, rot-v2, xor])\n",
+				WantErr:    fmt.Errorf("unknown cipher \"rot13\" (must be one of [rot, rot-v2, xor])"),
+			},
+		},
+		{
+			name: "lists config with cipher",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Cipher:    "xor",
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Cipher:           xor",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name:              "Writes secret config",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Secrets: map[string]*SecretSource{
+					"vault": {Type: "command", Args: []string{"pass", "show", "vault"}},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "secret", "vault", "command", "pass", "show", "vault"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					secretNameArg.Name(): "vault",
+					secretTypeArg.Name(): "command",
+					secretArgsArg.Name(): []string{"pass", "show", "vault"},
+				}},
+			},
+		},
+		{
+			name:              "fails to write secret config with unknown type",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "secret", "vault", "keychain"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					secretNameArg.Name(): "vault",
+					secretTypeArg.Name(): "keychain",
+				}},
+				WantStderr: "unknown secret type \"keychain\" (must be one of [command, env, file, prompt])\n",
+				WantErr:    fmt.Errorf("unknown secret type \"keychain\" (must be one of [command, env, file, prompt])"),
+			},
+		},
+		{
+			name:              "fails to write secret config with wrong number of args",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "secret", "work", "env"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					secretNameArg.Name(): "work",
+					secretTypeArg.Name(): "env",
+				}},
+				WantStderr: "env secrets require exactly 1 argument(s); got 0\n",
+				WantErr:    fmt.Errorf("env secrets require exactly 1 argument(s); got 0"),
+			},
+		},
+		{
+			name: "lists config with secrets",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Secrets: map[string]*SecretSource{
+					"work":  {Type: "env", Args: []string{"WORK_CODE"}},
+					"vault": {Type: "command", Args: []string{"pass", "show", "vault"}},
+				},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Secrets:",
+					"  vault: command pass show vault",
+					"  work: env WORK_CODE",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "Writes header template config",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "header.tmpl"),
+					contents:     headerTemplate,
+				},
+			},
+			want: &qmkWrapper{
+				QMKDir:         qw().QMKDir,
+				OutputDir:      qw().OutputDir,
+				HeaderTemplate: commandtest.FilepathAbs(t, "testdata", "header.tmpl"),
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "template", filepath.Join("testdata", "header.tmpl")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					templateFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "header.tmpl"),
+				}},
+			},
+		},
+		{
+			name: "fails to write header template config without LEEP_VERSION",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				{
+					expectedFile: commandtest.FilepathAbs(t, "testdata", "no_version.tmpl"),
+					contents:     "#pragma once\n",
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "template", filepath.Join("testdata", "no_version.tmpl")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					templateFileArg.Name(): commandtest.FilepathAbs(t, "testdata", "no_version.tmpl"),
+				}},
+				WantStderr: "header template must define LEEP_VERSION (used to detect leftover codes)\n",
+				WantErr:    fmt.Errorf("header template must define LEEP_VERSION (used to detect leftover codes)"),
+			},
+		},
+		{
+			name: "Resets header template config",
+			q: &qmkWrapper{
+				QMKDir:         qw().QMKDir,
+				OutputDir:      qw().OutputDir,
+				HeaderTemplate: filepath.Join("testdata", "header.tmpl"),
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want:              qw(),
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "template", "reset"},
+			},
+		},
+		{
+			name:              "Writes config with userspace and code file",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+				OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+				Userspace: "other",
+				CodeFile:  filepath.Join("keyboards", "kb", "codes.h"),
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--userspace", "other",
+					"--code-file", filepath.Join("keyboards", "kb", "codes.h"),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():     commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name():  commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					userspaceFlag.Name(): "other",
+					codeFileFlag.Name():  filepath.Join("keyboards", "kb", "codes.h"),
+				}},
+			},
+		},
+		{
+			name:              "Writes config with absolute code file",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+				OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+				CodeFile:  "codes.h",
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--code-file", commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk", "codes.h")),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					codeFileFlag.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk", "codes.h")),
+				}},
+			},
+		},
+		{
+			name:              "fails to write config with code file outside of qmk dir",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--code-file", filepath.Join("..", "codes.h"),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					codeFileFlag.Name(): filepath.Join("..", "codes.h"),
+				}},
+				WantStderr: fmt.Sprintf("code file %s must be inside the QMK directory (%s)\n", commandtest.FilepathAbs(t, "testdata", "codes.h"), commandtest.FilepathAbs(t, "testdata", "qmk")),
+				WantErr:    fmt.Errorf("code file %s must be inside the QMK directory (%s)", commandtest.FilepathAbs(t, "testdata", "codes.h"), commandtest.FilepathAbs(t, "testdata", "qmk")),
+			},
+		},
+		{
+			name:              "fails to write config with invalid userspace",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--userspace", filepath.Join("..", "other"),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():     commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name():  commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					userspaceFlag.Name(): filepath.Join("..", "other"),
+				}},
+				WantStderr: fmt.Sprintf("invalid userspace name %q\n", filepath.Join("..", "other")),
+				WantErr:    fmt.Errorf("invalid userspace name %q", filepath.Join("..", "other")),
+			},
+		},
+		{
+			name: "prints compile diagnostics",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{
+							"Compiling: users/leep-frog/leep_frog.c                             [ERRORS]",
+							"users/leep-frog/leep_frog.c:12:5: error: 'LEEP_CODE_3' undeclared",
+							"users/leep-frog/leep_frog.c:8:1: warning: unused variable 'x'",
+						},
+						Err: fmt.Errorf("exit status 2"),
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"Compiling: users/leep-frog/leep_frog.c                             [ERRORS]",
+					"users/leep-frog/leep_frog.c:12:5: error: 'LEEP_CODE_3' undeclared",
+					"users/leep-frog/leep_frog.c:8:1: warning: unused variable 'x'",
+					"Diagnostics: 1 error(s), 1 warning(s)",
+					"users/leep-frog/leep_frog.c",
+					"  8:1: warning: unused variable 'x'",
+					"  12:5: error: 'LEEP_CODE_3' undeclared",
+					"",
+				}, "\n"),
+				WantStderr: "failed to run qmk compile: failed to execute shell command: exit status 2\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: exit status 2"),
+			},
+		},
+		{
+			name: "fails if firmware is over size budget",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				SizeBudgets: map[string]*SizeBudget{
+					"kb": {MaxBytes: 28000},
+				},
+			},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{
+							"Checking file size of kb_km.bin                                    [OK]",
+							" * The firmware size is fine - 28123/28672 (98%, 549 bytes free)",
+						},
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"Checking file size of kb_km.bin                                    [OK]",
+					" * The firmware size is fine - 28123/28672 (98%, 549 bytes free)",
+					"Firmware size: 28123/28672 bytes (1.9% free)",
+					"",
+				}, "\n"),
+				WantStderr: "firmware is 123 bytes over its size budget (28123/28000 bytes)\n",
+				WantErr:    fmt.Errorf("firmware is 123 bytes over its size budget (28123/28000 bytes)"),
+			},
+		},
+		{
+			name: "prints compile diagnostics as JSON",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Snapshot code file
+				scrubbedCodeFile,
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"--json",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Stdout: []string{
+							"Compiling: users/leep-frog/leep_frog.c                             [ERRORS]",
+							"users/leep-frog/leep_frog.c:12:5: error: 'LEEP_CODE_3' undeclared",
+						},
+						Err: fmt.Errorf("exit status 2"),
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1"},
+					hexFileFlag.Name(): "bin",
+					jsonFlag.Name():    true,
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"{",
+					`  "errors": 1,`,
+					`  "warnings": 0,`,
+					`  "diagnostics": [`,
+					"    {",
+					`      "file": "users/leep-frog/leep_frog.c",`,
+					`      "line": 12,`,
+					`      "column": 5,`,
+					`      "severity": "error",`,
+					`      "message": "'LEEP_CODE_3' undeclared"`,
+					"    }",
+					"  ]",
+					"}",
+					"",
+				}, "\n"),
+				WantStderr: "failed to run qmk compile: failed to execute shell command: exit status 2\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: exit status 2"),
+			},
+		},
+		{
+			name: "fails if JSON is used with --flash",
+			q:    qw(),
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"kb", "km", "--json", "--flash"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					hexFileFlag.Name(): "bin",
+					jsonFlag.Name():    true,
+					flashFlag.Name():   true,
+				}},
+				WantStderr: "--json can't be used with --flash or --deploy-dir\n",
+				WantErr:    fmt.Errorf("--json can't be used with --flash or --deploy-dir"),
+			},
+		},
+		{
+			name: "fails if JSON is used with --deploy-dir",
+			q:    qw(),
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"kb", "km", "--json", "--deploy-dir", filepath.Join("testdata", "uf2")},
+				WantData: &command.Data{Values: map[string]interface{}{
+					hexFileFlag.Name():   "bin",
+					jsonFlag.Name():      true,
+					deployDirFlag.Name(): filepath.Join("testdata", "uf2"),
+				}},
+				WantStderr: "--json can't be used with --flash or --deploy-dir\n",
+				WantErr:    fmt.Errorf("--json can't be used with --flash or --deploy-dir"),
+			},
+		},
+		// Verify reproducible tests
+		{
+			name: "verifies reproducible build",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Build 1: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+				// Build 2: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 1: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Build 1: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 2: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Build 2: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"verify-reproducible",
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// Build 1: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+					// Build 2: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"Build 1 SHA-256: c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+					"Build 2 SHA-256: c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+					"kb_km.bin is reproducible",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "verifies reproducible build with codes read once",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Vault:     cloneVault(),
+			},
+			// The vault passphrase is only provided once.
+			secrets: []string{"hunter2"},
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Build 1: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+				// Build 2: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 1: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "vault-one"`,
+						`#define LEEP_CODE_2 "vault-two"`,
+						"",
+					}, "\n"),
+				},
+				// Build 1: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 2: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "vault-one"`,
+						`#define LEEP_CODE_2 "vault-two"`,
+						"",
+					}, "\n"),
+				},
+				// Build 2: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"verify-reproducible",
+					"kb",
+					"km",
+					"--vault-codes",
+					"1,2",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// Build 1: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+					// Build 2: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:       "kb",
+					keymapArgName:         "km",
+					vaultCodesFlag.Name(): "1,2",
+					hexFileFlag.Name():    "bin",
+					"VERSION":             "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"Build 1 SHA-256: c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+					"Build 2 SHA-256: c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+					"kb_km.bin is reproducible",
+					"",
+				}, "\n"),
+			},
+		},
+		{
+			name: "fails if builds are different",
+			q:    qw(),
+			readFileResponses: []*readFileResponse{
+				scrubbedCodeFile,
+				// Build 1: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+				// Build 2: snapshot code file
+				scrubbedCodeFile,
+				{
+					expectedFile: filepath.Join(qw().QMKDir, "kb_km.bin"),
+					contents:     "firmware v2",
+				},
+				// Verify restored code file
+				scrubbedCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 1: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Build 1: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+				// Lock code file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Build 2: write codes to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-09-09 01:46:40 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 ""`,
+						"",
+					}, "\n"),
+				},
+				// Build 2: write empty strings to file
+				{
+					expectedFile: filepath.Join(qw().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"verify-reproducible",
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// Build 1: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+					// Build 2: git log, describe, branch, and qmk compile
+					{
+						Stdout: []string{"1000000000"},
+					},
+					{},
+					{},
+					{},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1"},
+					hexFileFlag.Name(): "bin",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"log", "-1", "--format=%ct"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  qw().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+							"--clean",
+							"-e", "SKIP_VERSION=yes",
+						},
+						Dir: qw().QMKDir,
+					},
+				},
+				WantStdout: strings.Join([]string{
+					"Build 1 SHA-256: c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+					"Build 2 SHA-256: 3e8325bf983160235499f077069e902d19dc8c022039a6971e757d1349ddbde6",
+					"",
+				}, "\n"),
+				WantStderr: "kb_km.bin is not reproducible (builds have different SHA-256 hashes)\n",
+				WantErr:    fmt.Errorf("kb_km.bin is not reproducible (builds have different SHA-256 hashes)"),
+			},
+		},
+		// Mode tests
+		{
+			name: "prints mode",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Mode:      "qmk",
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"mode"},
+				WantStdout: "qmk\n",
+			},
+		},
+		{
+			name:              "prints default mode",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:       []string{"mode"},
+				WantStdout: "basic\n",
+			},
+		},
+		{
+			name:              "sets qmk mode",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Mode:      "qmk",
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"mode", "qmk"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					modeArg.Name(): "qmk",
+				}},
+				WantExecuteData: &command.ExecuteData{
+					Executable: []string{
+						"export LEEP_QMK=qmk",
+						`if [ -n "$ZSH_VERSION" ]; then`,
+						`  bindkey '^H' backward-kill-word`,
+						`else`,
+						`  bind '"\C-h":backward-kill-word'`,
+						`fi`,
+					},
+				},
+			},
+		},
+		{
+			name:              "sets basic mode",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Mode:      "basic",
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"mode", "basic"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					modeArg.Name(): "basic",
+				}},
+				WantExecuteData: &command.ExecuteData{
+					Executable: []string{
+						"export LEEP_QMK=basic",
+						`if [ -n "$ZSH_VERSION" ]; then`,
+						`  bindkey '^H' backward-delete-char`,
+						`else`,
+						`  bind '"\C-h":backward-delete-char'`,
+						`fi`,
+					},
+				},
+			},
+		},
+		{
+			name:              "fails to set unknown mode",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"mode", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					modeArg.Name(): "vial",
+				}},
+				WantStderr: "unknown mode \"vial\" (must be one of [basic, qmk])\n",
+				WantErr:    fmt.Errorf("unknown mode \"vial\" (must be one of [basic, qmk])"),
+			},
+		},
+		// Profile tests
+		{
+			name: "compiles with profile",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles:  map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{
+				vialCodeFile,
+				// Snapshot code file
+				vialCodeFile,
+				// Verify restored code file
+				vialCodeFile,
+			},
+			writeFileResponses: []*writeFileResponse{
+				// Lock code file
+				{
+					expectedFile: filepath.Join(vial().QMKDir, codeFile) + lockFileSuffix,
+					expectedData: "1234",
+				},
+				// Write codes to file
+				{
+					expectedFile: filepath.Join(vial().QMKDir, codeFile),
+					expectedData: strings.Join([]string{
+						"#pragma once",
+						`#define LEEP_VERSION "2001-02-03 04:05:06 abc123"`,
+						`#define LEEP_CODE_1 "message 1"`,
+						`#define LEEP_CODE_2 "message two"`,
+						"",
+					}, "\n"),
+				},
+				// Write empty strings to file
+				{
+					expectedFile: filepath.Join(vial().QMKDir, codeFile),
+					expectedData: scrubbedCodeFile.contents,
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"kb",
+					"km",
+					"--codes",
+					"message 1",
+					"message two",
+					"--profile",
+					"vial",
+				},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+					// git describe
+					{},
+					// git branch
+					{},
+					{
+						Err: fmt.Errorf("oops"),
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					codesFlag.Name():   []string{"message 1", "message two"},
+					hexFileFlag.Name(): "bin",
+					profileFlag.Name(): "vial",
+					"VERSION":          "abc123def456",
+				}},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  vial().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"describe", "--always", "--dirty"},
+						Dir:  vial().QMKDir,
+					},
+					{
+						Name: "git",
+						Args: []string{"branch", "--show-current"},
+						Dir:  vial().QMKDir,
+					},
+					{
+						Name: "qmk",
+						Args: []string{
+							"compile",
+							"--keyboard", "kb",
+							"--keymap", "km",
+						},
+						Dir: vial().QMKDir,
+					},
+				},
+				WantStderr: "failed to run qmk compile: failed to execute shell command: oops\n",
+				WantErr:    fmt.Errorf("failed to run qmk compile: failed to execute shell command: oops"),
+			},
+		},
+		{
+			name: "fails to compile with unknown profile",
+			q:    qw(),
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"kb", "km", "--profile", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					hexFileFlag.Name(): "bin",
+					profileFlag.Name(): "vial",
+				}},
+				WantStderr: "unknown profile \"vial\" (`q config profile add`)\n",
+				WantErr:    fmt.Errorf("unknown profile \"vial\" (`q config profile add`)"),
+			},
+		},
+		{
+			name: "flashes with active profile artifact type",
+			q: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles: map[string]*Profile{
+					"vial": {
+						QMKDir:    vial().QMKDir,
+						OutputDir: vial().OutputDir,
+						Artifact:  "uf2",
+					},
+				},
+			},
+			readFileResponses: []*readFileResponse{vialCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args:         []string{"flash", "kb", "km"},
+				RunResponses: []*commandtest.FakeRun{{}},
+				WantRunContents: []*commandtest.RunContents{{
+					Name: "qmk",
+					Args: []string{"flash", filepath.Join(vial().OutputDir, "kb_km.uf2")},
+				}},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:    "kb",
+					keymapArgName:      "km",
+					hexFileFlag.Name(): "bin",
+				}},
+				WantStdout: fmt.Sprintf("Successfully flashed %s\n", filepath.Join(vial().OutputDir, "kb_km.uf2")),
+			},
+		},
+		{
+			name: "lists config with profiles",
+			q: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles: map[string]*Profile{
+					"vial": {
+						QMKDir:    vial().QMKDir,
+						OutputDir: vial().OutputDir,
+						Artifact:  "hex",
+					},
+					"other": {
+						QMKDir:    filepath.Join("other", "qmk"),
+						OutputDir: filepath.Join("other", "output"),
+					},
+				},
+			},
+			readFileResponses: []*readFileResponse{vialCodeFile},
 			etc: &commandtest.ExecuteTestCase{
 				Args: []string{"config", "list"},
 				WantStdout: strings.Join([]string{
-					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
-					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					fmt.Sprintf("QMK Directory:    %s", vial().QMKDir),
+					fmt.Sprintf("Output Directory: %s", vial().OutputDir),
+					"Artifact:         hex",
+					"Profiles:",
+					fmt.Sprintf("  default: %s -> %s", qw().QMKDir, qw().OutputDir),
+					fmt.Sprintf("  other: %s -> %s", filepath.Join("other", "qmk"), filepath.Join("other", "output")),
+					fmt.Sprintf("* vial: %s -> %s", vial().QMKDir, vial().OutputDir),
 					"",
 				}, "\n"),
 			},
 		},
 		{
-			name: "Writes config",
-			q:    qw(),
+			name:              "adds profile",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles: map[string]*Profile{
+					"vial": {
+						QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+						OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+						Userspace: "other",
+						Artifact:  "hex",
+					},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "profile", "add", "vial",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--userspace", "other",
+					"--artifact", "hex",
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "vial",
+					qmkDirArg.Name():      commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name():   commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					userspaceFlag.Name():  "other",
+					artifactFlag.Name():   "hex",
+				}},
+			},
+		},
+		{
+			name:              "fails to add existing profile",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "profile", "add", "default",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "default",
+					qmkDirArg.Name():      commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name():   commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+				}},
+				WantStderr: "profile \"default\" already exists\n",
+				WantErr:    fmt.Errorf("profile \"default\" already exists"),
+			},
+		},
+		{
+			name: "removes profile",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles:  map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles:  map[string]*Profile{},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "profile", "remove", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "vial",
+				}},
+			},
+		},
+		{
+			name: "fails to remove active profile",
+			q: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles:      map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{vialCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "profile", "remove", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "vial",
+				}},
+				WantStderr: "profile \"vial\" is active (`q config use default` first)\n",
+				WantErr:    fmt.Errorf("profile \"vial\" is active (`q config use default` first)"),
+			},
+		},
+		{
+			name: "uses profile",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles:  map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles:      map[string]*Profile{"vial": vial()},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "use", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "vial",
+				}},
+			},
+		},
+		{
+			name: "uses default profile",
+			q: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles:      map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{vialCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Profiles:  map[string]*Profile{"vial": vial()},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "use", "default"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "default",
+				}},
+			},
+		},
+		{
+			name:              "fails to use unknown profile",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "use", "vial"},
+				WantData: &command.Data{Values: map[string]interface{}{
+					profileNameArg.Name(): "vial",
+				}},
+				WantStderr: "unknown profile \"vial\" (`q config profile add`)\n",
+				WantErr:    fmt.Errorf("unknown profile \"vial\" (`q config profile add`)"),
+			},
+		},
+		{
+			name: "writes config to active profile",
+			q: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles:      map[string]*Profile{"vial": vial()},
+			},
+			readFileResponses: []*readFileResponse{vialCodeFile},
+			want: &qmkWrapper{
+				QMKDir:        qw().QMKDir,
+				OutputDir:     qw().OutputDir,
+				ActiveProfile: "vial",
+				Profiles: map[string]*Profile{
+					"vial": {
+						QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+						OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+						Artifact:  "uf2",
+					},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--artifact", "uf2",
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					artifactFlag.Name(): "uf2",
+				}},
+			},
+		},
+		{
+			name:              "sets deploy directory",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
 			want: &qmkWrapper{
 				QMKDir:    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
 				OutputDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+				Artifact:  "uf2",
+				DeployDir: commandtest.FilepathAbs(t, filepath.Join("testdata", "uf2")),
 			},
 			etc: &commandtest.ExecuteTestCase{
-				Args: []string{"config", "set", filepath.Join("testdata", "qmk"), filepath.Join("testdata", "out", "put")},
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--artifact", "uf2",
+					"--deploy-dir", filepath.Join("testdata", "uf2"),
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					qmkDirArg.Name():     commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
+					outputDirArg.Name():  commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					artifactFlag.Name():  "uf2",
+					deployDirFlag.Name(): filepath.Join("testdata", "uf2"),
+				}},
+			},
+		},
+		{
+			name:              "fails to set invalid artifact type",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{
+					"config", "set",
+					filepath.Join("testdata", "qmk"),
+					filepath.Join("testdata", "out", "put"),
+					"--artifact", "elf",
+				},
 				WantData: &command.Data{Values: map[string]interface{}{
 					qmkDirArg.Name():    commandtest.FilepathAbs(t, filepath.Join("testdata", "qmk")),
 					outputDirArg.Name(): commandtest.FilepathAbs(t, filepath.Join("testdata", "out", "put")),
+					artifactFlag.Name(): "elf",
 				}},
+				WantStderr: "invalid artifact type \"elf\" (must be one of [bin, hex, uf2])\n",
+				WantErr:    fmt.Errorf("invalid artifact type \"elf\" (must be one of [bin, hex, uf2])"),
+			},
+		},
+		{
+			name: "lists config with deploy directory",
+			q: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Artifact:  "uf2",
+				DeployDir: filepath.Join("media", "uf2"),
+			},
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"config", "list"},
+				WantStdout: strings.Join([]string{
+					fmt.Sprintf("QMK Directory:    %s", qw().QMKDir),
+					fmt.Sprintf("Output Directory: %s", qw().OutputDir),
+					"Artifact:         uf2",
+					fmt.Sprintf("Deploy Directory: %s", filepath.Join("media", "uf2")),
+					"",
+				}, "\n"),
 			},
 		},
 		// Shortcut tests (only need one test; assume all other logic works based on tests in command package)
 		{
-			name: "Adds shortcut",
-			q:    qw(),
+			name:              "Adds shortcut",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
 			want: &qmkWrapper{
 				QMKDir:    qw().QMKDir,
 				OutputDir: qw().OutputDir,
@@ -1106,8 +6607,8 @@ func TestMain(t *testing.T) {
 					},
 				},
 				WantData: &command.Data{Values: map[string]interface{}{
-					keyboardArg.Name():           "kb/subkb",
-					keymapArg.Name():             "km",
+					keyboardArgName:              "kb/subkb",
+					keymapArgName:                "km",
 					codesFlag.Name():             []string{"shortcut-message-1", "msg2"},
 					commander.ShortcutArg.Name(): "p",
 					hexFileFlag.Name():           "bin",
@@ -1115,6 +6616,43 @@ func TestMain(t *testing.T) {
 				}},
 			},
 		},
+		{
+			name:              "Adds shortcut with secrets",
+			q:                 qw(),
+			readFileResponses: []*readFileResponse{scrubbedCodeFile},
+			want: &qmkWrapper{
+				QMKDir:    qw().QMKDir,
+				OutputDir: qw().OutputDir,
+				Shortcuts: map[string]map[string][]string{
+					shortcutName: {
+						"p": []string{"kb/subkb", "km", "--secret", "1=work"},
+					},
+				},
+			},
+			etc: &commandtest.ExecuteTestCase{
+				Args: []string{"shortcuts", "add", "p", "kb/subkb", "km", "--secret", "1=work"},
+				RunResponses: []*commandtest.FakeRun{
+					{
+						Stdout: []string{"abc123def456"},
+					},
+				},
+				WantRunContents: []*commandtest.RunContents{
+					{
+						Name: "git",
+						Args: []string{"rev-parse", "HEAD"},
+						Dir:  qw().QMKDir,
+					},
+				},
+				WantData: &command.Data{Values: map[string]interface{}{
+					keyboardArgName:              "kb/subkb",
+					keymapArgName:                "km",
+					secretFlag.Name():            []string{"1=work"},
+					commander.ShortcutArg.Name(): "p",
+					hexFileFlag.Name():           "bin",
+					"VERSION":                    "abc123def456",
+				}},
+			},
+		},
 		/* Useful for commenting out tests. */
 	} {
 		t.Run(test.name, func(t *testing.T) {
@@ -1154,6 +6692,38 @@ func TestMain(t *testing.T) {
 				return res.err
 			})
 
+			// The lock file is created like any other written file.
+			commandtest.StubValue(t, &writeNewFile, func(s string, data []byte, perm os.FileMode) error {
+				return osWriteFile(s, data, perm)
+			})
+			commandtest.StubValue(t, &osMkdirAll, func(string, os.FileMode) error { return nil })
+			commandtest.StubValue(t, &osRemove, func(string) error { return nil })
+			commandtest.StubValue(t, &osGetpid, func() int { return 1234 })
+			commandtest.StubValue(t, &processRunning, func(pid int) bool { return pid == 1234 || pid == 5678 })
+
+			commandtest.StubValue(t, &osLookupEnv, func(key string) (string, bool) {
+				v, ok := test.env[key]
+				return v, ok
+			})
+
+			commandtest.StubValue(t, &osStat, func(name string) (os.FileInfo, error) {
+				for _, r := range test.gitRepos {
+					if name == filepath.Join(r, ".git") {
+						return os.Stat("testdata")
+					}
+				}
+				return os.Stat(name)
+			})
+
+			commandtest.StubValue(t, &readSecret, func(command.Output, string) (string, error) {
+				if len(test.secrets) == 0 {
+					return "", fmt.Errorf("no input provided")
+				}
+				s := test.secrets[0]
+				test.secrets = test.secrets[1:]
+				return s, nil
+			})
+
 			commandertest.ExecuteTest(t, test.etc)
 			commandertest.ChangeTest(t, test.want, test.q, cmpopts.IgnoreUnexported(qmkWrapper{}), cmpopts.EquateEmpty())
 		})
@@ -1166,12 +6736,95 @@ func TestMetadata(t *testing.T) {
 		t.Errorf("qmkWrapper.Name() returned wrong value (-want, +got):\n%s", diff)
 	}
 
-	if diff := cmp.Diff([]string(nil), qw.Setup()); diff != "" {
+	wantSetup := []string{
+		"export LEEP_QMK=basic",
+		`if [ -n "$ZSH_VERSION" ]; then`,
+		`  bindkey '^H' backward-delete-char`,
+		`else`,
+		`  bind '"\C-h":backward-delete-char'`,
+		`fi`,
+	}
+	if diff := cmp.Diff(wantSetup, qw.Setup()); diff != "" {
 		t.Errorf("qmkWrapper.Setup() returned wrong value (-want, +got):\n%s", diff)
 	}
 
 	// CLI() doesn't error
 	CLI("abc", "")
+	CLI("abc", "", &CodeSlot{Name: "work", HashKey: "def"})
+}
+
+func TestModeSurvivesReload(t *testing.T) {
+	qw := &qmkWrapper{}
+	wantLines := []string{
+		"export LEEP_QMK=qmk",
+		`if [ -n "$ZSH_VERSION" ]; then`,
+		`  bindkey '^H' backward-kill-word`,
+		`else`,
+		`  bind '"\C-h":backward-kill-word'`,
+		`fi`,
+	}
+	commandertest.ExecuteTest(t, &commandtest.ExecuteTestCase{
+		Node: qw.Node(),
+		Args: []string{"mode", "qmk"},
+		WantData: &command.Data{Values: map[string]interface{}{
+			modeArg.Name(): "qmk",
+		}},
+		WantExecuteData: &command.ExecuteData{
+			Executable: wantLines,
+		},
+	})
+	if !qw.Changed() {
+		t.Fatalf("q mode qmk didn't change the config")
+	}
+
+	// New shells load the saved config (rather than inheriting LEEP_QMK).
+	b, err := json.Marshal(qw)
+	if err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+	reloaded := &qmkWrapper{}
+	if err := json.Unmarshal(b, reloaded); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if diff := cmp.Diff(wantLines, reloaded.Setup()); diff != "" {
+		t.Errorf("qmkWrapper.Setup() returned wrong value after reload (-want, +got):\n%s", diff)
+	}
+}
+
+func TestCLIPanicsOnInvalidSlots(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		slots []*CodeSlot
+		want  string
+	}{
+		{
+			name:  "invalid slot name",
+			slots: []*CodeSlot{{Name: "work-laptop"}},
+			want:  `invalid code slot name "work-laptop" (must match ^[a-zA-Z0-9_]+$)`,
+		},
+		{
+			name:  "duplicate slot name",
+			slots: []*CodeSlot{{Name: "2"}},
+			want:  `code slot "2" registered more than once`,
+		},
+		{
+			name: "slot names that only differ by case",
+			slots: []*CodeSlot{
+				{Name: "work"},
+				{Name: "Work"},
+			},
+			want: `code slots "work" and "Work" both define LEEP_CODE_WORK`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if diff := cmp.Diff(test.want, recover()); diff != "" {
+					t.Errorf("CLI() panicked with wrong value (-want, +got):\n%s", diff)
+				}
+			}()
+			CLI("abc", "def", test.slots...)
+		})
+	}
 }
 
 func TestRot(t *testing.T) {
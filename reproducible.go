@@ -0,0 +1,108 @@
+package qmkwrapper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// sourceDateEpochEnv is the standard environment variable for the
+	// timestamp of a reproducible build (https://reproducible-builds.org/specs/source-date-epoch/).
+	sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+)
+
+// reproducible returns whether the build should be reproducible (the
+// `--reproducible` flag, SOURCE_DATE_EPOCH, or `q verify-reproducible`).
+func (qw *qmkWrapper) reproducible(d *command.Data) bool {
+	if _, ok := osLookupEnv(sourceDateEpochEnv); ok {
+		return true
+	}
+	return qw.forceReproducible || reproducibleFlag.Get(d)
+}
+
+// buildTime returns the timestamp embedded in the code file. Reproducible
+// builds use SOURCE_DATE_EPOCH or, if that isn't set, the commit time so that
+// builds of the same commit are identical.
+func (qw *qmkWrapper) buildTime(o command.Output, d *command.Data) (time.Time, error) {
+	if v, ok := osLookupEnv(sourceDateEpochEnv); ok {
+		return parseEpoch(v)
+	}
+	if !qw.reproducible(d) {
+		return timeNow(), nil
+	}
+	ct, err := gitOutput(o, d, qw.profile().QMKDir, "log", "-1", "--format=%ct")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get commit time: %v", err)
+	}
+	t, err := parseEpoch(ct)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse commit time: %v", err)
+	}
+	return t, nil
+}
+
+func parseEpoch(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s value %q (must be seconds since the Unix epoch)", sourceDateEpochEnv, s)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// verifyReproducible builds the keymap twice and checks that both builds
+// produce an identical artifact.
+func (qw *qmkWrapper) verifyReproducible(o command.Output, d *command.Data, kb, km, version string) error {
+	qw.forceReproducible = true
+
+	// Codes are only read once (secrets may prompt for input).
+	codes, err := qw.codes(o, d)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	var sums []string
+	var bf string
+	for i := 1; i <= 2; i++ {
+		var sum string
+		bf, sum, err = qw.buildSHA256(o, d, codes, version, kb, km)
+		if err != nil {
+			return err
+		}
+		o.Stdoutf("Build %d SHA-256: %s\n", i, sum)
+		sums = append(sums, sum)
+	}
+	if sums[0] != sums[1] {
+		return o.Err(fmt.Errorf("%s is not reproducible (builds have different SHA-256 hashes)", bf))
+	}
+	o.Stdoutf("%s is reproducible\n", bf)
+	return nil
+}
+
+// buildSHA256 does a clean build of the keymap and returns the artifact name
+// and its SHA-256 hash.
+func (qw *qmkWrapper) buildSHA256(o command.Output, d *command.Data, codes map[string]string, version, kb, km string) (string, string, error) {
+	cleanup, err := qw.writeCodeFile(o, d, codes, version, kb, km)
+	if err != nil {
+		return "", "", err
+	}
+	defer cleanup()
+
+	qmkDir := qw.profile().QMKDir
+	start := timeNow()
+	if _, err := qw.qmkCompile(o, d, kb, km, true, "--clean"); err != nil {
+		return "", "", o.Annotate(err, "failed to run qmk compile")
+	}
+	af := qw.artifactFile(d, qmkDir, kb, km, start)
+	data, err := osReadFile(filepath.Join(qmkDir, af))
+	if err != nil {
+		return "", "", o.Annotate(err, "failed to read artifact")
+	}
+	sum := sha256.Sum256(data)
+	return filepath.Base(af), hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,169 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leep-frog/command/command"
+)
+
+const (
+	// scrubbedVersion is the LEEP_VERSION of a code file with no codes in it.
+	scrubbedVersion = "auto-generated"
+	// timedVersionFormat is the prefix of LEEP_VERSION for a code file
+	// written by a build.
+	timedVersionFormat = "2006-01-02 15:04:05 "
+	// lockFileSuffix is the suffix of the file (next to the code file) that
+	// contains the PID of the build that wrote codes to the code file.
+	lockFileSuffix = ".lock"
+)
+
+var (
+	// Vars so can stub out in tests
+	signalNotify = signal.Notify
+	signalStop   = signal.Stop
+	osExit       = os.Exit
+	osGetpid     = os.Getpid
+	osRemove     = os.Remove
+	// writeNewFile writes the data to the file, failing if the file already
+	// exists (so only one process can create it).
+	writeNewFile = func(f string, data []byte, perm os.FileMode) error {
+		fh, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+		if _, err := fh.Write(data); err != nil {
+			fh.Close()
+			return err
+		}
+		return fh.Close()
+	}
+	// processRunning returns whether the process with the PID is running.
+	processRunning = func(pid int) bool {
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			return false
+		}
+		return p.Signal(syscall.Signal(0)) == nil
+	}
+
+	leepVersionRegex = regexp.MustCompile(`(?m)^#define LEEP_VERSION "(.*)"$`)
+)
+
+// scrubOnSignal calls scrub and exits if the process is interrupted or
+// terminated. The returned function stops listening for signals.
+func scrubOnSignal(scrub func(os.Signal)) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signalNotify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			scrub(sig)
+			osExit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signalStop(ch)
+		close(done)
+	}
+}
+
+// lockCodeFile records that this process is writing codes to the code file
+// so other commands don't remove them mid-build and other builds don't write
+// their own codes over them. The returned function removes the lock.
+func lockCodeFile(f string) (func(), error) {
+	lf := f + lockFileSuffix
+	pid := []byte(strconv.Itoa(osGetpid()))
+	err := writeNewFile(lf, pid, 0644)
+	if os.IsExist(err) {
+		if owner := codeFileLockOwner(f); owner != 0 {
+			return nil, fmt.Errorf("code file is locked by another build (PID %d); wait for it to finish and try again", owner)
+		}
+		// The lock was left behind by a build that is no longer running.
+		if err := osRemove(lf); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale code file lock: %v", err)
+		}
+		err = writeNewFile(lf, pid, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock code file: %v", err)
+	}
+	return func() { osRemove(lf) }, nil
+}
+
+// codeFileLockOwner returns the PID of the running build that locked the code
+// file (or 0 if the code file isn't locked by a running build).
+func codeFileLockOwner(f string) int {
+	b, err := osReadFile(f + lockFileSuffix)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid == osGetpid() || !processRunning(pid) {
+		return 0
+	}
+	return pid
+}
+
+// isBuildVersion returns whether the LEEP_VERSION was written by a build.
+func isBuildVersion(version string) bool {
+	if len(version) < len(timedVersionFormat) {
+		return false
+	}
+	_, err := time.Parse(timedVersionFormat, version[:len(timedVersionFormat)])
+	return err == nil
+}
+
+// scrubLeftoverCodes removes codes that were left in the code file by a
+// build that was killed before it could clean up after itself.
+func (qw *qmkWrapper) scrubLeftoverCodes(o command.Output) error {
+	if qw.profile().QMKDir == "" {
+		return nil
+	}
+
+	f := qw.codeFilePath()
+	b, err := osReadFile(f)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		o.Stderrf("WARNING: failed to check %s for leftover codes: %v\n", f, err)
+		return nil
+	}
+
+	// Only remove code files written by a build (hand-maintained code files
+	// are restored as-is after a build, so they shouldn't be touched here).
+	m := leepVersionRegex.FindSubmatch(b)
+	if m == nil || !isBuildVersion(string(m[1])) {
+		return nil
+	}
+	// The codes belong to a build that is still running (e.g. in another terminal).
+	if codeFileLockOwner(f) != 0 {
+		return nil
+	}
+
+	o.Stderrf("WARNING: %s contains codes from an interrupted build (version %q); removing them\n", f, m[1])
+	hd := qw.headerData(scrubbedVersion, nil)
+	contents, err := qw.codeFileContents(hd)
+	if err != nil {
+		// The codes need to be removed regardless.
+		o.Stderrf("WARNING: %v; using the default header template\n", err)
+		if contents, err = executeHeaderTemplate(defaultHeaderTemplate, hd); err != nil {
+			return o.Annotatef(err, "CRITICAL: failed to remove leftover codes")
+		}
+	}
+	if err := osWriteFile(f, contents, 0644); err != nil {
+		return o.Annotatef(err, "CRITICAL: failed to remove leftover codes")
+	}
+	if err := osRemove(f + lockFileSuffix); err != nil && !os.IsNotExist(err) {
+		o.Stderrf("WARNING: failed to remove stale lock file: %v\n", err)
+	}
+	return nil
+}
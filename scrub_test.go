@@ -0,0 +1,116 @@
+package qmkwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/commandtest"
+)
+
+func TestScrubOnSignal(t *testing.T) {
+	var notified chan<- os.Signal
+	commandtest.StubValue(t, &signalNotify, func(c chan<- os.Signal, sigs ...os.Signal) {
+		notified = c
+	})
+	var stopped bool
+	commandtest.StubValue(t, &signalStop, func(c chan<- os.Signal) {
+		stopped = true
+	})
+	exited := make(chan int, 1)
+	commandtest.StubValue(t, &osExit, func(code int) {
+		exited <- code
+	})
+
+	var scrubbed []os.Signal
+	scrubOnSignal(func(sig os.Signal) {
+		scrubbed = append(scrubbed, sig)
+	})
+	notified <- os.Interrupt
+
+	if diff := cmp.Diff(1, <-exited); diff != "" {
+		t.Errorf("scrubOnSignal() exited with wrong code (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]os.Signal{os.Interrupt}, scrubbed); diff != "" {
+		t.Errorf("scrubOnSignal() scrubbed wrong signals (-want, +got):\n%s", diff)
+	}
+	if stopped {
+		t.Errorf("scrubOnSignal() stopped listening for signals before stop was called")
+	}
+}
+
+func TestScrubOnSignalStop(t *testing.T) {
+	var stopped bool
+	commandtest.StubValue(t, &signalStop, func(c chan<- os.Signal) {
+		stopped = true
+	})
+	commandtest.StubValue(t, &osExit, func(code int) {
+		t.Errorf("scrubOnSignal() exited with code %d after stop was called", code)
+	})
+
+	stop := scrubOnSignal(func(sig os.Signal) {
+		t.Errorf("scrubOnSignal() scrubbed after stop was called")
+	})
+	stop()
+
+	if !stopped {
+		t.Errorf("scrubOnSignal() stop didn't stop listening for signals")
+	}
+}
+
+func TestLockCodeFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "codes.h")
+	commandtest.StubValue(t, &processRunning, func(pid int) bool { return pid == 1234 })
+
+	// Not locked
+	if diff := cmp.Diff(0, codeFileLockOwner(f)); diff != "" {
+		t.Errorf("codeFileLockOwner() returned wrong owner for unlocked file (-want, +got):\n%s", diff)
+	}
+
+	// Locked by a running build
+	commandtest.StubValue(t, &osGetpid, func() int { return 1234 })
+	unlock, err := lockCodeFile(f)
+	if err != nil {
+		t.Fatalf("lockCodeFile() returned error: %v", err)
+	}
+	commandtest.StubValue(t, &osGetpid, func() int { return 1 })
+	if diff := cmp.Diff(1234, codeFileLockOwner(f)); diff != "" {
+		t.Errorf("codeFileLockOwner() returned wrong owner for locked file (-want, +got):\n%s", diff)
+	}
+
+	// Can't be locked while a running build holds the lock
+	if _, err := lockCodeFile(f); err == nil {
+		t.Errorf("lockCodeFile() returned nil error for file locked by a running build")
+	}
+	if b, err := os.ReadFile(f + lockFileSuffix); err != nil || string(b) != "1234" {
+		t.Errorf("lockCodeFile() changed the running build's lock (contents %q, error %v)", b, err)
+	}
+
+	// Locked by this process
+	commandtest.StubValue(t, &osGetpid, func() int { return 1234 })
+	if diff := cmp.Diff(0, codeFileLockOwner(f)); diff != "" {
+		t.Errorf("codeFileLockOwner() returned wrong owner for file locked by this process (-want, +got):\n%s", diff)
+	}
+
+	// Locked by a build that is no longer running
+	commandtest.StubValue(t, &osGetpid, func() int { return 1 })
+	commandtest.StubValue(t, &processRunning, func(pid int) bool { return false })
+	if diff := cmp.Diff(0, codeFileLockOwner(f)); diff != "" {
+		t.Errorf("codeFileLockOwner() returned wrong owner for stale lock (-want, +got):\n%s", diff)
+	}
+
+	// A stale lock is replaced
+	unlock, err = lockCodeFile(f)
+	if err != nil {
+		t.Fatalf("lockCodeFile() returned error for stale lock: %v", err)
+	}
+	if b, err := os.ReadFile(f + lockFileSuffix); err != nil || string(b) != "1" {
+		t.Errorf("lockCodeFile() didn't replace the stale lock (contents %q, error %v)", b, err)
+	}
+
+	unlock()
+	if _, err := os.Stat(f + lockFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("unlock didn't remove the lock file: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commander"
+)
+
+const (
+	// envSecret reads the code from an environment variable.
+	envSecret = "env"
+	// fileSecret reads the code from a file only readable by the current user.
+	fileSecret = "file"
+	// promptSecret reads the code from stdin (without echoing it).
+	promptSecret = "prompt"
+	// commandSecret reads the code from the output of a command
+	// (e.g. `pass show <name>`).
+	commandSecret = "command"
+)
+
+var (
+	// Vars so can stub out in tests
+	osLookupEnv = os.LookupEnv
+	osStat      = os.Stat
+
+	// Number of args required for each secret type (-1 for at least one).
+	secretTypeArgs = map[string]int{
+		envSecret:     1,
+		fileSecret:    1,
+		promptSecret:  0,
+		commandSecret: -1,
+	}
+)
+
+// SecretSource is a named location codes are read from, so codes never need
+// to be passed as arguments (or stored in shortcuts).
+type SecretSource struct {
+	// Type is one of "env", "file", "prompt", or "command".
+	Type string
+	// Args are the environment variable name (env), the file path (file),
+	// or the command and its arguments (command).
+	Args []string
+}
+
+func (ss *SecretSource) String() string {
+	return strings.Join(append([]string{ss.Type}, ss.Args...), " ")
+}
+
+func (ss *SecretSource) validate() error {
+	want, ok := secretTypeArgs[ss.Type]
+	if !ok {
+		var types []string
+		for t := range secretTypeArgs {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return fmt.Errorf("unknown secret type %q (must be one of [%s])", ss.Type, strings.Join(types, ", "))
+	}
+	if want < 0 && len(ss.Args) == 0 {
+		return fmt.Errorf("%s secrets require at least 1 argument", ss.Type)
+	}
+	if want >= 0 && len(ss.Args) != want {
+		return fmt.Errorf("%s secrets require exactly %d argument(s); got %d", ss.Type, want, len(ss.Args))
+	}
+	return nil
+}
+
+// read returns the secret value for the code slot.
+func (ss *SecretSource) read(o command.Output, d *command.Data, slot string) (string, error) {
+	if err := ss.validate(); err != nil {
+		return "", err
+	}
+	switch ss.Type {
+	case envSecret:
+		v, ok := osLookupEnv(ss.Args[0])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ss.Args[0])
+		}
+		return v, nil
+	case fileSecret:
+		return readSecretFile(ss.Args[0])
+	case promptSecret:
+		return readSecret(o, fmt.Sprintf("Code %s: ", slot))
+	default:
+		sc := &commander.ShellCommand[string]{
+			CommandName: ss.Args[0],
+			Args:        ss.Args[1:],
+		}
+		return sc.Run(o, d)
+	}
+}
+
+// readSecretFile reads a secret from a file, refusing files that other users
+// can access.
+func readSecretFile(f string) (string, error) {
+	fi, err := osStat(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat secret file: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return "", fmt.Errorf("secret file %s is accessible by other users (mode %#o; must be 0600)", f, perm)
+	}
+	b, err := osReadFile(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// secretCodes adds the codes for slots provided with the `--secret` flag.
+func (qw *qmkWrapper) secretCodes(o command.Output, d *command.Data, codes map[string]string) error {
+	if !secretFlag.Provided(d) {
+		return nil
+	}
+	for _, s := range secretFlag.Get(d) {
+		slot, name, ok := strings.Cut(s, "=")
+		if !ok || slot == "" || name == "" {
+			return fmt.Errorf("invalid --secret value %q (must be SLOT=SECRET_NAME)", s)
+		}
+		if _, err := qw.slot(slot); err != nil {
+			return err
+		}
+		ss, ok := qw.Secrets[name]
+		if !ok {
+			return fmt.Errorf("unknown secret %q (`q config secret`)", name)
+		}
+		if _, ok := codes[slot]; ok {
+			return fmt.Errorf("code %s provided more than once", slot)
+		}
+		v, err := ss.read(o, d, slot)
+		if err != nil {
+			return fmt.Errorf("failed to read secret %q for code %s: %v", name, slot, err)
+		}
+		codes[slot] = v
+	}
+	return nil
+}
+
+func (qw *qmkWrapper) listSecrets(o command.Output) {
+	if len(qw.Secrets) == 0 {
+		return
+	}
+	var names []string
+	for n := range qw.Secrets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	o.Stdoutln("Secrets:")
+	for _, n := range names {
+		o.Stdoutf("  %s: %s\n", n, qw.Secrets[n])
+	}
+}
@@ -0,0 +1,72 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents string
+		perm     os.FileMode
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "reads secret file",
+			contents: "s3cret\n",
+			perm:     0600,
+			want:     "s3cret",
+		},
+		{
+			name:     "reads owner read-only secret file",
+			contents: "s3cret",
+			perm:     0400,
+			want:     "s3cret",
+		},
+		{
+			name:     "fails if group can read secret file",
+			contents: "s3cret\n",
+			perm:     0640,
+			wantErr:  "secret file %s is accessible by other users (mode 0640; must be 0600)",
+		},
+		{
+			name:     "fails if anyone can read secret file",
+			contents: "s3cret\n",
+			perm:     0644,
+			wantErr:  "secret file %s is accessible by other users (mode 0644; must be 0600)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "secret")
+			if err := os.WriteFile(f, []byte(test.contents), test.perm); err != nil {
+				t.Fatalf("failed to write secret file: %v", err)
+			}
+			// WriteFile is subject to the umask.
+			if err := os.Chmod(f, test.perm); err != nil {
+				t.Fatalf("failed to chmod secret file: %v", err)
+			}
+
+			got, err := readSecretFile(f)
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			var wantErr string
+			if test.wantErr != "" {
+				wantErr = fmt.Sprintf(test.wantErr, f)
+			}
+			if diff := cmp.Diff(wantErr, gotErr); diff != "" {
+				t.Errorf("readSecretFile() returned wrong error (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("readSecretFile() returned wrong value (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
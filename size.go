@@ -0,0 +1,153 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+)
+
+var (
+	// QMK's size check (e.g. "The firmware size is fine - 27590/28672 (96%,
+	// 1082 bytes free)" or "The firmware is too large! 29124/28672 (452 bytes
+	// over)").
+	firmwareSizeRegex = regexp.MustCompile(`The firmware (?:size )?is .*?(\d+)/(\d+)`)
+)
+
+// FirmwareSize is the size of the firmware reported by `qmk compile`.
+type FirmwareSize struct {
+	// Used is the size of the firmware in bytes.
+	Used int `json:"used"`
+	// Max is the flash available for the firmware in bytes.
+	Max int `json:"max"`
+}
+
+// Free returns the number of bytes of flash left.
+func (fs *FirmwareSize) Free() int {
+	return fs.Max - fs.Used
+}
+
+// PercentFree returns the percent of flash left.
+func (fs *FirmwareSize) PercentFree() float64 {
+	if fs.Max == 0 {
+		return 0
+	}
+	return 100 * float64(fs.Free()) / float64(fs.Max)
+}
+
+func (fs *FirmwareSize) String() string {
+	return fmt.Sprintf("%d/%d bytes (%.1f%% free)", fs.Used, fs.Max, fs.PercentFree())
+}
+
+// parseFirmwareSize returns the firmware size in the output of `qmk compile`
+// (nil if it isn't reported).
+func parseFirmwareSize(lines []string) *FirmwareSize {
+	for _, l := range lines {
+		m := firmwareSizeRegex.FindStringSubmatch(ansiRegex.ReplaceAllString(l, ""))
+		if m == nil {
+			continue
+		}
+		used, _ := strconv.Atoi(m[1])
+		max, _ := strconv.Atoi(m[2])
+		return &FirmwareSize{used, max}
+	}
+	return nil
+}
+
+// SizeBudget is the size limit for a keyboard's firmware. Exactly one of the
+// fields is set.
+type SizeBudget struct {
+	// MaxBytes is the largest the firmware can be.
+	MaxBytes int `json:",omitempty"`
+	// MinPercentFree is the least percent of flash that must be left.
+	MinPercentFree int `json:",omitempty"`
+}
+
+func (sb *SizeBudget) String() string {
+	if sb.MinPercentFree > 0 {
+		return fmt.Sprintf("%d%% free", sb.MinPercentFree)
+	}
+	return fmt.Sprintf("%d bytes", sb.MaxBytes)
+}
+
+// parseSizeBudget parses a budget in bytes (e.g. 28000) or percent of flash
+// to keep free (e.g. 10%).
+func parseSizeBudget(s string) (*SizeBudget, error) {
+	invalid := fmt.Errorf("invalid size budget %q (must be bytes or percent of flash to keep free, e.g. 28000 or 10%%)", s)
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n >= 100 {
+			return nil, invalid
+		}
+		return &SizeBudget{MinPercentFree: n}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return nil, invalid
+	}
+	return &SizeBudget{MaxBytes: n}, nil
+}
+
+// check returns an error if the firmware is over budget.
+func (sb *SizeBudget) check(fs *FirmwareSize) error {
+	if sb.MaxBytes > 0 && fs.Used > sb.MaxBytes {
+		return fmt.Errorf("firmware is %d bytes over its size budget (%d/%d bytes)", fs.Used-sb.MaxBytes, fs.Used, sb.MaxBytes)
+	}
+	if sb.MinPercentFree > 0 && fs.PercentFree() < float64(sb.MinPercentFree) {
+		return fmt.Errorf("firmware is over its size budget (%.1f%% free, budget is %d%% free)", fs.PercentFree(), sb.MinPercentFree)
+	}
+	return nil
+}
+
+// checkSizeBudget returns an error if the keyboard's firmware is over its size
+// budget (if it has one).
+func (qw *qmkWrapper) checkSizeBudget(kb string, fs *FirmwareSize) error {
+	sb, ok := qw.SizeBudgets[kb]
+	if !ok {
+		return nil
+	}
+	if fs == nil {
+		return fmt.Errorf("qmk didn't report the firmware size (needed for the size budget of %s)", kb)
+	}
+	return sb.check(fs)
+}
+
+func (qw *qmkWrapper) setSizeBudget(kb, budget string) error {
+	sb, err := parseSizeBudget(budget)
+	if err != nil {
+		return err
+	}
+	if qw.SizeBudgets == nil {
+		qw.SizeBudgets = map[string]*SizeBudget{}
+	}
+	qw.SizeBudgets[kb] = sb
+	qw.changed = true
+	return nil
+}
+
+func (qw *qmkWrapper) removeSizeBudget(kb string) error {
+	if _, ok := qw.SizeBudgets[kb]; !ok {
+		return fmt.Errorf("no size budget for keyboard %q", kb)
+	}
+	delete(qw.SizeBudgets, kb)
+	qw.changed = true
+	return nil
+}
+
+func (qw *qmkWrapper) listSizeBudgets(o command.Output) {
+	if len(qw.SizeBudgets) == 0 {
+		return
+	}
+	var kbs []string
+	for kb := range qw.SizeBudgets {
+		kbs = append(kbs, kb)
+	}
+	sort.Strings(kbs)
+	o.Stdoutln("Size Budgets:")
+	for _, kb := range kbs {
+		o.Stdoutf("  %s: %s\n", kb, qw.SizeBudgets[kb])
+	}
+}
@@ -0,0 +1,112 @@
+package qmkwrapper
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFirmwareSize(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		lines []string
+		want  *FirmwareSize
+	}{
+		{
+			name: "no size",
+			lines: []string{
+				"Linking: .build/kb_km.elf                                          [OK]",
+			},
+		},
+		{
+			name: "parses size",
+			lines: []string{
+				"Checking file size of kb_km.hex                                    [OK]",
+				" * The firmware size is fine - 27590/28672 (96%, 1082 bytes free)",
+			},
+			want: &FirmwareSize{27590, 28672},
+		},
+		{
+			name: "parses size near the limit",
+			lines: []string{
+				" * \x1b[33;01mThe firmware size is approaching the maximum\x1b[0m - 28500/28672 (99%, 172 bytes free)",
+			},
+			want: &FirmwareSize{28500, 28672},
+		},
+		{
+			name: "parses size over the limit",
+			lines: []string{
+				" * \x1b[31;01mThe firmware is too large!\x1b[0m 29124/28672 (452 bytes over)",
+			},
+			want: &FirmwareSize{29124, 28672},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, parseFirmwareSize(test.lines)); diff != "" {
+				t.Errorf("parseFirmwareSize(%v) returned diff (-want, +got):\n%s", test.lines, diff)
+			}
+		})
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	for _, test := range []struct {
+		budget string
+		size   *FirmwareSize
+		// wantErr is the error returned by parseSizeBudget.
+		wantErr   string
+		wantCheck string
+	}{
+		{
+			budget: "28000",
+			size:   &FirmwareSize{27590, 28672},
+		},
+		{
+			budget:    "27000",
+			size:      &FirmwareSize{27590, 28672},
+			wantCheck: `firmware is 590 bytes over its size budget (27590/27000 bytes)`,
+		},
+		{
+			budget: "3%",
+			size:   &FirmwareSize{27590, 28672},
+		},
+		{
+			budget:    "5%",
+			size:      &FirmwareSize{27590, 28672},
+			wantCheck: `firmware is over its size budget (3.8% free, budget is 5% free)`,
+		},
+		{
+			budget:  "0",
+			wantErr: `invalid size budget "0" (must be bytes or percent of flash to keep free, e.g. 28000 or 10%)`,
+		},
+		{
+			budget:  "100%",
+			wantErr: `invalid size budget "100%" (must be bytes or percent of flash to keep free, e.g. 28000 or 10%)`,
+		},
+		{
+			budget:  "28KB",
+			wantErr: `invalid size budget "28KB" (must be bytes or percent of flash to keep free, e.g. 28000 or 10%)`,
+		},
+	} {
+		t.Run(test.budget, func(t *testing.T) {
+			sb, err := parseSizeBudget(test.budget)
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Fatalf("parseSizeBudget(%q) returned wrong error (-want, +got):\n%s", test.budget, diff)
+			}
+			if err != nil {
+				return
+			}
+			var gotCheck string
+			if err := sb.check(test.size); err != nil {
+				gotCheck = err.Error()
+			}
+			if diff := cmp.Diff(test.wantCheck, gotCheck); diff != "" {
+				t.Errorf("SizeBudget(%s).check(%v) returned wrong error (-want, +got):\n%s", sb, test.size, diff)
+			}
+		})
+	}
+}
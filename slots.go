@@ -0,0 +1,90 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+)
+
+var (
+	slotNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// CodeSlot is a code that is written to the code file as LEEP_CODE_<NAME>.
+type CodeSlot struct {
+	// Name is the name of the slot. It is used to provide the code
+	// (`--code NAME=VALUE`) and, upper-cased, in the name of the define.
+	Name string
+	// HashKey is the key the code is hashed with when `--hash` is provided.
+	HashKey string
+}
+
+func (cs *CodeSlot) define() string {
+	return fmt.Sprintf("LEEP_CODE_%s", strings.ToUpper(cs.Name))
+}
+
+// defaultSlots returns the LEEP_CODE_1 and LEEP_CODE_2 slots (which are set
+// by the `--codes` flag).
+func defaultSlots(key1, key2 string) []*CodeSlot {
+	return []*CodeSlot{
+		{Name: "1", HashKey: key1},
+		{Name: "2", HashKey: key2},
+	}
+}
+
+// codeSlots returns all slots in the order they are written to the code file.
+func (qw *qmkWrapper) codeSlots() []*CodeSlot {
+	if qw.slots == nil {
+		return defaultSlots("", "")
+	}
+	return qw.slots
+}
+
+func (qw *qmkWrapper) slot(name string) (*CodeSlot, error) {
+	var names []string
+	for _, cs := range qw.codeSlots() {
+		if cs.Name == name {
+			return cs, nil
+		}
+		names = append(names, cs.Name)
+	}
+	return nil, fmt.Errorf("unknown code slot %q (must be one of [%s])", name, strings.Join(names, ", "))
+}
+
+// codes returns the provided code for each slot (from the `--codes`,
+// `--code`, `--secret`, and `--vault-codes` flags). Slots without a provided code are left out.
+func (qw *qmkWrapper) codes(o command.Output, d *command.Data) (map[string]string, error) {
+	codes := map[string]string{}
+	if codesFlag.Provided(d) {
+		c := codesFlag.Get(d)
+		codes["1"], codes["2"] = c[0], c[1]
+	}
+	var named []string
+	if codeFlag.Provided(d) {
+		named = codeFlag.Get(d)
+	}
+	for _, nc := range named {
+		// Don't include the value in errors since it's a secret.
+		name, value, ok := strings.Cut(nc, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --code value (must be NAME=VALUE)")
+		}
+		if _, err := qw.slot(name); err != nil {
+			return nil, err
+		}
+		if _, ok := codes[name]; ok {
+			return nil, fmt.Errorf("code %s provided more than once", name)
+		}
+		codes[name] = value
+	}
+
+	if err := qw.secretCodes(o, d, codes); err != nil {
+		return nil, err
+	}
+	if err := qw.vaultCodes(o, d, codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
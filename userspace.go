@@ -0,0 +1,45 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// userspace returns the userspace directory (relative to the QMK directory).
+func (qw *qmkWrapper) userspace() string {
+	p := qw.profile()
+	if p.Userspace == "" {
+		return userspaceDir
+	}
+	return filepath.Join("users", p.Userspace)
+}
+
+// codeFilePath returns the path to the code file.
+func (qw *qmkWrapper) codeFilePath() string {
+	p := qw.profile()
+	if p.CodeFile != "" {
+		return filepath.Join(p.QMKDir, p.CodeFile)
+	}
+	return filepath.Join(p.QMKDir, qw.userspace(), codeFileName)
+}
+
+func validateUserspace(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid userspace name %q", name)
+	}
+	return nil
+}
+
+// relativeCodeFile returns the code file path relative to the QMK directory.
+// Relative paths are relative to the QMK directory.
+func relativeCodeFile(qmkDir, f string) (string, error) {
+	if !filepath.IsAbs(f) {
+		f = filepath.Join(qmkDir, f)
+	}
+	rel, err := filepath.Rel(qmkDir, f)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("code file %s must be inside the QMK directory (%s)", f, qmkDir)
+	}
+	return rel, nil
+}
@@ -0,0 +1,288 @@
+package qmkwrapper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// vaultCheck is encrypted with the vault key so the passphrase can be
+	// verified before any codes are added.
+	vaultCheck    = "qmkwrapper vault"
+	vaultSaltSize = 16
+	vaultKeySize  = 32
+	// vaultBlockSize and vaultParallelism are the scrypt r and p parameters.
+	vaultBlockSize   = 8
+	vaultParallelism = 1
+)
+
+var (
+	// Vars so can stub out in tests
+	randRead = rand.Read
+	// vaultCost is the scrypt CPU/memory cost (N) used for new vaults.
+	vaultCost = 1 << 15
+)
+
+// Vault stores codes encrypted (with AES-GCM) by a key derived from a
+// passphrase, so codes can be kept in the CLI's config between builds.
+type Vault struct {
+	Salt []byte
+	// Cost is the scrypt CPU/memory cost (N) the key is derived with.
+	Cost int
+	// Check is vaultCheck encrypted with the vault key.
+	Check []byte
+	// Codes are the encrypted codes keyed by code slot.
+	Codes map[string][]byte
+}
+
+func newVault(passphrase string, cost int) (*Vault, error) {
+	salt := make([]byte, vaultSaltSize)
+	if _, err := randRead(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	v := &Vault{
+		Salt:  salt,
+		Cost:  cost,
+		Codes: map[string][]byte{},
+	}
+	aead, err := v.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if v.Check, err = vaultSeal(aead, "", vaultCheck); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Vault) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), v.Salt, v.Cost, vaultBlockSize, vaultParallelism, vaultKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive vault key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// unlock returns the vault cipher, verifying the passphrase is correct.
+func (v *Vault) unlock(passphrase string) (cipher.AEAD, error) {
+	aead, err := v.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := vaultOpen(aead, "", v.Check); err != nil || check != vaultCheck {
+		return nil, fmt.Errorf("incorrect vault passphrase")
+	}
+	return aead, nil
+}
+
+func (v *Vault) add(passphrase, name, code string) error {
+	aead, err := v.unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	if v.Codes == nil {
+		v.Codes = map[string][]byte{}
+	}
+	if v.Codes[name], err = vaultSeal(aead, name, code); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decrypt returns the decrypted codes for the provided names.
+func (v *Vault) decrypt(passphrase string, names []string) (map[string]string, error) {
+	aead, err := v.unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	codes := map[string]string{}
+	for _, n := range names {
+		data, ok := v.Codes[n]
+		if !ok {
+			return nil, fmt.Errorf("no code %q in the vault", n)
+		}
+		if codes[n], err = vaultOpen(aead, n, data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt code %q: %v", n, err)
+		}
+	}
+	return codes, nil
+}
+
+func (v *Vault) names() []string {
+	var names []string
+	for n := range v.Codes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rotate returns a new vault with all codes re-encrypted with the new passphrase.
+func (v *Vault) rotate(oldPassphrase, newPassphrase string, cost int) (*Vault, error) {
+	codes, err := v.decrypt(oldPassphrase, v.names())
+	if err != nil {
+		return nil, err
+	}
+	nv, err := newVault(newPassphrase, cost)
+	if err != nil {
+		return nil, err
+	}
+	for n, c := range codes {
+		if err := nv.add(newPassphrase, n, c); err != nil {
+			return nil, err
+		}
+	}
+	return nv, nil
+}
+
+// vaultSeal encrypts the plaintext. The name is used as additional data so
+// encrypted codes can't be swapped between names.
+func vaultSeal(aead cipher.AEAD, name, plaintext string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := randRead(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, []byte(plaintext), []byte(name)), nil
+}
+
+func vaultOpen(aead cipher.AEAD, name string, data []byte) (string, error) {
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted data is too short")
+	}
+	b, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (qw *qmkWrapper) vaultAdd(o command.Output, name string) error {
+	if _, err := qw.slot(name); err != nil {
+		return o.Err(err)
+	}
+
+	v := qw.Vault
+	var passphrase string
+	var err error
+	if v == nil {
+		if passphrase, err = readNewPassphrase(o); err != nil {
+			return o.Err(err)
+		}
+		if v, err = newVault(passphrase, vaultCost); err != nil {
+			return o.Annotate(err, "failed to create vault")
+		}
+	} else if passphrase, err = readSecret(o, "Vault passphrase: "); err != nil {
+		return o.Annotate(err, "failed to read vault passphrase")
+	}
+
+	code, err := readSecret(o, fmt.Sprintf("Code %s: ", name))
+	if err != nil {
+		return o.Annotate(err, "failed to read code")
+	}
+	if err := v.add(passphrase, name, code); err != nil {
+		return o.Annotatef(err, "failed to add code %q to the vault", name)
+	}
+	qw.Vault = v
+	qw.changed = true
+	return nil
+}
+
+// readNewPassphrase reads a new vault passphrase twice so a typo doesn't lock
+// codes in the vault.
+func readNewPassphrase(o command.Output) (string, error) {
+	passphrase, err := readSecret(o, "New vault passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("failed to read new vault passphrase: %v", err)
+	}
+	confirm, err := readSecret(o, "Confirm new vault passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("failed to read new vault passphrase: %v", err)
+	}
+	if passphrase != confirm {
+		return "", fmt.Errorf("vault passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func (qw *qmkWrapper) listVault(o command.Output) error {
+	if qw.Vault == nil {
+		return nil
+	}
+	for _, n := range qw.Vault.names() {
+		o.Stdoutln(n)
+	}
+	return nil
+}
+
+func (qw *qmkWrapper) vaultRemove(o command.Output, name string) error {
+	if qw.Vault == nil || qw.Vault.Codes[name] == nil {
+		return o.Err(fmt.Errorf("no code %q in the vault", name))
+	}
+	delete(qw.Vault.Codes, name)
+	qw.changed = true
+	return nil
+}
+
+func (qw *qmkWrapper) vaultRotate(o command.Output) error {
+	if qw.Vault == nil {
+		return o.Err(fmt.Errorf("vault is empty (`q vault add`)"))
+	}
+	oldPassphrase, err := readSecret(o, "Vault passphrase: ")
+	if err != nil {
+		return o.Annotate(err, "failed to read vault passphrase")
+	}
+	newPassphrase, err := readNewPassphrase(o)
+	if err != nil {
+		return o.Err(err)
+	}
+	v, err := qw.Vault.rotate(oldPassphrase, newPassphrase, vaultCost)
+	if err != nil {
+		return o.Annotate(err, "failed to rotate vault passphrase")
+	}
+	qw.Vault = v
+	qw.changed = true
+	return nil
+}
+
+// vaultCodes adds the codes for slots provided with the `--vault-codes` flag.
+func (qw *qmkWrapper) vaultCodes(o command.Output, d *command.Data, codes map[string]string) error {
+	if !vaultCodesFlag.Provided(d) {
+		return nil
+	}
+	if qw.Vault == nil {
+		return fmt.Errorf("vault is empty (`q vault add`)")
+	}
+	names := strings.Split(vaultCodesFlag.Get(d), ",")
+	for _, n := range names {
+		if _, err := qw.slot(n); err != nil {
+			return err
+		}
+		if _, ok := codes[n]; ok {
+			return fmt.Errorf("code %s provided more than once", n)
+		}
+	}
+
+	passphrase, err := readSecret(o, "Vault passphrase: ")
+	if err != nil {
+		return fmt.Errorf("failed to read vault passphrase: %v", err)
+	}
+	vc, err := qw.Vault.decrypt(passphrase, names)
+	if err != nil {
+		return err
+	}
+	for n, c := range vc {
+		codes[n] = c
+	}
+	return nil
+}
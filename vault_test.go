@@ -0,0 +1,114 @@
+package qmkwrapper
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testVault returns a vault with the provided codes (using the minimum scrypt
+// cost so tests are fast).
+func testVault(t *testing.T, passphrase string, codes map[string]string) *Vault {
+	t.Helper()
+	v, err := newVault(passphrase, 2)
+	if err != nil {
+		t.Fatalf("newVault() returned error: %v", err)
+	}
+	for n, c := range codes {
+		if err := v.add(passphrase, n, c); err != nil {
+			t.Fatalf("Vault.add(%s) returned error: %v", n, err)
+		}
+	}
+	return v
+}
+
+func TestVault(t *testing.T) {
+	v := testVault(t, "hunter2", map[string]string{
+		"work": "work-code",
+		"home": "home-code",
+	})
+
+	if diff := cmp.Diff([]string{"home", "work"}, v.names()); diff != "" {
+		t.Errorf("Vault.names() returned wrong value (-want, +got):\n%s", diff)
+	}
+
+	got, err := v.decrypt("hunter2", []string{"work"})
+	if err != nil {
+		t.Fatalf("Vault.decrypt() returned error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"work": "work-code"}, got); diff != "" {
+		t.Errorf("Vault.decrypt() returned wrong codes (-want, +got):\n%s", diff)
+	}
+
+	for _, test := range []struct {
+		name       string
+		passphrase string
+		names      []string
+		setup      func(v *Vault)
+		wantErr    string
+	}{
+		{
+			name:       "wrong passphrase",
+			passphrase: "hunter3",
+			names:      []string{"work"},
+			wantErr:    "incorrect vault passphrase",
+		},
+		{
+			name:       "unknown code",
+			passphrase: "hunter2",
+			names:      []string{"vault"},
+			wantErr:    `no code "vault" in the vault`,
+		},
+		{
+			name:       "swapped codes",
+			passphrase: "hunter2",
+			names:      []string{"work"},
+			setup: func(v *Vault) {
+				v.Codes["work"] = v.Codes["home"]
+			},
+			wantErr: `failed to decrypt code "work": cipher: message authentication failed`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cv := &Vault{
+				Salt:  v.Salt,
+				Cost:  v.Cost,
+				Check: v.Check,
+				Codes: map[string][]byte{},
+			}
+			for n, c := range v.Codes {
+				cv.Codes[n] = c
+			}
+			if test.setup != nil {
+				test.setup(cv)
+			}
+			_, err := cv.decrypt(test.passphrase, test.names)
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Errorf("Vault.decrypt() returned wrong error (-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	if err := v.add("hunter3", "other", "other-code"); err == nil {
+		t.Errorf("Vault.add() with wrong passphrase returned nil error")
+	}
+
+	rv, err := v.rotate("hunter2", "correct horse", 2)
+	if err != nil {
+		t.Fatalf("Vault.rotate() returned error: %v", err)
+	}
+	got, err = rv.decrypt("correct horse", rv.names())
+	if err != nil {
+		t.Fatalf("Vault.decrypt() after rotate returned error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"work": "work-code", "home": "home-code"}, got); diff != "" {
+		t.Errorf("Vault.decrypt() after rotate returned wrong codes (-want, +got):\n%s", diff)
+	}
+	if _, err := rv.decrypt("hunter2", rv.names()); err == nil {
+		t.Errorf("Vault.decrypt() with old passphrase after rotate returned nil error")
+	}
+}
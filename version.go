@@ -0,0 +1,57 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commander"
+)
+
+const (
+	// dirtySuffix is added to the output of `git describe --dirty` when the
+	// working tree has uncommitted changes.
+	dirtySuffix = "-dirty"
+)
+
+// addGitMetadata adds the source state of the QMK repo (and of the userspace,
+// if it is a separate repo) to the header data. It must be called before the
+// codes are written so they don't make the working tree dirty.
+func (qw *qmkWrapper) addGitMetadata(o command.Output, d *command.Data, hd *HeaderData) error {
+	qmkDir := qw.profile().QMKDir
+	describe, err := gitOutput(o, d, qmkDir, "describe", "--always", "--dirty")
+	if err != nil {
+		return fmt.Errorf("failed to describe QMK commit: %v", err)
+	}
+	hd.Describe = strings.TrimSuffix(describe, dirtySuffix)
+	hd.Dirty = strings.HasSuffix(describe, dirtySuffix)
+	if hd.Branch, err = gitOutput(o, d, qmkDir, "branch", "--show-current"); err != nil {
+		return fmt.Errorf("failed to get QMK branch: %v", err)
+	}
+
+	usDir := filepath.Join(qmkDir, qw.userspace())
+	if _, err := osStat(filepath.Join(usDir, ".git")); err != nil {
+		// The userspace is part of the QMK repo.
+		return nil
+	}
+	if hd.UserspaceCommit, err = gitOutput(o, d, usDir, "rev-parse", "HEAD"); err != nil {
+		return fmt.Errorf("failed to get userspace commit: %v", err)
+	}
+	status, err := gitOutput(o, d, usDir, "status", "--porcelain")
+	if err != nil {
+		return fmt.Errorf("failed to get userspace status: %v", err)
+	}
+	hd.Dirty = hd.Dirty || status != ""
+	return nil
+}
+
+func gitOutput(o command.Output, d *command.Data, dir string, args ...string) (string, error) {
+	sc := &commander.ShellCommand[string]{
+		CommandName: "git",
+		Args:        args,
+		Dir:         dir,
+	}
+	out, err := sc.Run(o, d)
+	return strings.TrimSpace(out), err
+}
@@ -0,0 +1,159 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leep-frog/command/command"
+	"github.com/leep-frog/command/commander"
+)
+
+var (
+	// Vars so can stub out in tests
+	timeSleep         = time.Sleep
+	watchPollInterval = 500 * time.Millisecond
+	watchDebounce     = time.Second
+)
+
+// keymapDir returns the directory containing the keymap. QMK allows keymaps
+// to live in any parent directory of the keyboard, so this walks up from the
+// keyboard directory until the keymap is found.
+func keymapDir(qmkDir, kb, km string) (string, error) {
+	root := filepath.Join(qmkDir, "keyboards")
+	for dir := filepath.Join(root, kb); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		p := filepath.Join(dir, "keymaps", km)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("keymap %q not found for keyboard %q", km, kb)
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher polls a set of directories for file changes.
+type watcher struct {
+	dirs []string
+	// ignore contains files that are modified by the build itself.
+	ignore map[string]bool
+	last   map[string]*fileState
+}
+
+func newWatcher(ignore []string, dirs ...string) (*watcher, error) {
+	w := &watcher{
+		dirs:   dirs,
+		ignore: map[string]bool{},
+	}
+	for _, f := range ignore {
+		w.ignore[f] = true
+	}
+	last, err := w.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	w.last = last
+	return w, nil
+}
+
+func (w *watcher) snapshot() (map[string]*fileState, error) {
+	m := map[string]*fileState{}
+	for _, dir := range w.dirs {
+		err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if de.IsDir() || w.ignore[path] {
+				return nil
+			}
+			info, err := de.Info()
+			if os.IsNotExist(err) {
+				// File was removed mid-walk; the next snapshot will pick it up.
+				return nil
+			} else if err != nil {
+				return err
+			}
+			m[path] = &fileState{info.ModTime(), info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", dir, err)
+		}
+	}
+	return m, nil
+}
+
+func snapshotsEqual(a, b map[string]*fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, as := range a {
+		bs, ok := b[path]
+		if !ok || as.size != bs.size || !as.modTime.Equal(bs.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until a change is detected and no further changes have been
+// made for watchDebounce (so a burst of saves only triggers one build).
+func (w *watcher) wait() error {
+	var lastChange time.Time
+	for {
+		timeSleep(watchPollInterval)
+		snap, err := w.snapshot()
+		if err != nil {
+			return err
+		}
+		if !snapshotsEqual(w.last, snap) {
+			w.last = snap
+			lastChange = timeNow()
+			continue
+		}
+		if !lastChange.IsZero() && timeNow().Sub(lastChange) >= watchDebounce {
+			return nil
+		}
+	}
+}
+
+// watch compiles the keymap and then recompiles it every time the keymap or
+// userspace files change. It only returns if watching fails.
+func (qw *qmkWrapper) watch(o command.Output, d *command.Data, kb, km string, versionCommand *commander.ShellCommand[string]) error {
+	kmDir, err := keymapDir(qw.profile().QMKDir, kb, km)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	w, err := newWatcher([]string{qw.codeFilePath()}, kmDir, filepath.Join(qw.profile().QMKDir, qw.userspace()))
+	if err != nil {
+		return o.Annotate(err, "failed to start watcher")
+	}
+
+	// Codes are only read once so rebuilds don't stop to prompt for secrets
+	// (or the vault passphrase).
+	codes, err := qw.codes(o, d)
+	if err != nil {
+		return o.Err(err)
+	}
+
+	for {
+		// Build errors are already written to stderr and shouldn't stop the watch.
+		if version, err := versionCommand.Run(o, d); err != nil {
+			o.Annotate(err, "failed to get version")
+		} else {
+			qw.compile(o, d, kb, km, version, codes)
+		}
+
+		o.Stdoutf("Watching %s for changes...\n", strings.Join(w.dirs, ", "))
+		if err := w.wait(); err != nil {
+			return o.Annotate(err, "failed to watch for changes")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package qmkwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/leep-frog/command/commandtest"
+)
+
+func TestKeymapDir(t *testing.T) {
+	qmkDir := t.TempDir()
+	for _, dir := range []string{
+		filepath.Join("keyboards", "splitkb", "kyria", "rev3"),
+		filepath.Join("keyboards", "splitkb", "kyria", "keymaps", "leep"),
+		filepath.Join("keyboards", "splitkb", "kyria", "rev3", "keymaps", "rev3-only"),
+	} {
+		if err := os.MkdirAll(filepath.Join(qmkDir, dir), 0755); err != nil {
+			t.Fatalf("failed to create test directory: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		kb      string
+		km      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "finds keymap in keyboard directory",
+			kb:   "splitkb/kyria/rev3",
+			km:   "rev3-only",
+			want: filepath.Join(qmkDir, "keyboards", "splitkb", "kyria", "rev3", "keymaps", "rev3-only"),
+		},
+		{
+			name: "finds keymap in parent directory",
+			kb:   "splitkb/kyria/rev3",
+			km:   "leep",
+			want: filepath.Join(qmkDir, "keyboards", "splitkb", "kyria", "keymaps", "leep"),
+		},
+		{
+			name:    "fails if keymap doesn't exist",
+			kb:      "splitkb/kyria/rev3",
+			km:      "other",
+			wantErr: `keymap "other" not found for keyboard "splitkb/kyria/rev3"`,
+		},
+		{
+			name:    "doesn't look outside of keyboards directory",
+			kb:      "../..",
+			km:      "leep",
+			wantErr: `keymap "leep" not found for keyboard "../.."`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := keymapDir(qmkDir, test.kb, test.km)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("keymapDir(%s, %s) returned wrong value (-want, +got):\n%s", test.kb, test.km, diff)
+			}
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(test.wantErr, gotErr); diff != "" {
+				t.Errorf("keymapDir(%s, %s) returned wrong error (-want, +got):\n%s", test.kb, test.km, diff)
+			}
+		})
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "keymap.c")
+	ignored := filepath.Join(dir, "codes.h")
+	for _, f := range []string{src, ignored} {
+		if err := os.WriteFile(f, []byte("initial"), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	w, err := newWatcher([]string{ignored}, dir)
+	if err != nil {
+		t.Fatalf("newWatcher() returned error: %v", err)
+	}
+	if _, ok := w.last[ignored]; ok {
+		t.Errorf("newWatcher() included ignored file in snapshot")
+	}
+
+	now := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	commandtest.StubValue(t, &timeNow, func() time.Time { return now })
+
+	// Simulate a burst of saves over the first two polls.
+	var sleeps int
+	commandtest.StubValue(t, &timeSleep, func(d time.Duration) {
+		now = now.Add(d)
+		sleeps++
+		if sleeps <= 2 {
+			if err := os.WriteFile(src, []byte(fmt.Sprintf("save %d", sleeps)), 0644); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+			if err := os.Chtimes(src, now, now); err != nil {
+				t.Fatalf("failed to update test file time: %v", err)
+			}
+		}
+	})
+
+	if err := w.wait(); err != nil {
+		t.Fatalf("watcher.wait() returned error: %v", err)
+	}
+	// Two polls with changes followed by two quiet polls to reach the debounce duration.
+	if diff := cmp.Diff(4, sleeps); diff != "" {
+		t.Errorf("watcher.wait() slept wrong number of times (-want, +got):\n%s", diff)
+	}
+}